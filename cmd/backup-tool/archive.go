@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/pipeline"
+	"db-backup-tool/pkg/storage"
+	"db-backup-tool/pkg/utils"
+)
+
+// archivedFile is a server log file, such as a MySQL binlog or a PostgreSQL
+// WAL segment, kept in storage for point-in-time recovery
+type archivedFile struct {
+	// name is the file's name on the server, e.g. binlog.000042
+	name string
+	path string
+}
+
+// listArchived returns the files archived under prefix, sorted by name
+func listArchived(ctx context.Context, store core.Storage, prefix string) ([]archivedFile, error) {
+	paths, err := store.ListFiles(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var files []archivedFile
+	for _, p := range paths {
+		files = append(files, archivedFile{name: archivedName(p), path: p})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// archivedName returns the server's name for an archived file
+func archivedName(p string) string {
+	return strings.TrimSuffix(encryption.TrimExt(path.Base(p)), ".gz")
+}
+
+// archivedPath returns where a file called name is archived under prefix
+func archivedPath(prefix, name string, enc encryption.Encrypter) string {
+	dest := path.Join(prefix, name+".gz")
+	if enc != nil {
+		dest += enc.Ext()
+	}
+	return dest
+}
+
+// archiveFile compresses and encrypts the local file and stores it under
+// prefix, replacing an earlier copy. It returns the storage path.
+func archiveFile(ctx context.Context, store core.Storage, enc encryption.Encrypter, local, prefix string) (string, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dest := archivedPath(prefix, filepath.Base(local), enc)
+	produce := func(ctx context.Context, w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	}
+	return dest, archiveStream(ctx, store, enc, produce, dest)
+}
+
+// archiveStream compresses and encrypts what produce writes and stores it
+// at dest
+func archiveStream(ctx context.Context, store core.Storage, enc encryption.Encrypter, produce pipeline.Producer, dest string) error {
+	stages := []pipeline.Stage{utils.NewCompressWriter}
+	if enc != nil {
+		stages = append(stages, enc.NewWriter)
+	}
+	consume := func(ctx context.Context, r io.Reader) error {
+		_, err := storage.Put(ctx, store, r, dest)
+		return err
+	}
+	return pipeline.Run(ctx, produce, stages, consume)
+}
+
+// openArchived returns the decrypted and decompressed contents of an
+// archived file
+func openArchived(ctx context.Context, store core.Storage, remote string, kr *encryption.Keyring) (io.ReadCloser, error) {
+	rc, err := storage.Open(ctx, store, remote)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := openPayload(rc, true, kr)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &archivedReader{ReadCloser: payload, rc: rc}, nil
+}
+
+// archivedExists reports whether remote exists in store
+func archivedExists(ctx context.Context, store core.Storage, remote string) (bool, error) {
+	rc, err := storage.Open(ctx, store, remote)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rc.Close()
+	return true, nil
+}
+
+// archivedReader closes the stored object along with the payload read from it
+type archivedReader struct {
+	io.ReadCloser
+	rc io.Closer
+}
+
+func (r *archivedReader) Close() error {
+	err := r.ReadCloser.Close()
+	if cerr := r.rc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fetchArchived downloads, decrypts and decompresses an archived file to
+// local
+func fetchArchived(ctx context.Context, store core.Storage, remote, local string, kr *encryption.Keyring) error {
+	payload, err := openArchived(ctx, store, remote, kr)
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, payload)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
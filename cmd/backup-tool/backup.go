@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/manifest"
+	"db-backup-tool/pkg/pipeline"
+	"db-backup-tool/pkg/storage"
+	"db-backup-tool/pkg/utils"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	backupAll         bool
+	backupTags        []string
+	backupConcurrency int
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup [db_name...]",
+	Short: "Backup one or more databases",
+	Long: `Backup the named databases, every database with --all, or the databases
+carrying one of the given tags (databases.<name>.tags in the config file).
+
+Databases are backed up independently: one failure doesn't stop the others.
+A summary is printed at the end and a single notification is sent.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := selectDatabases(args, backupAll, backupTags)
+		if err != nil {
+			return err
+		}
+		if backupConcurrency < 1 {
+			return fmt.Errorf("--concurrency must be at least 1")
+		}
+
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		storageAdapter, err := getStorageAdapter(ctx)
+		if err != nil {
+			utils.LogError(err.Error())
+			return err
+		}
+
+		results := make([]backupResult, len(names))
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < backupConcurrency && w < len(names); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					results[i] = backupDatabase(ctx, names[i], storageAdapter)
+				}
+			}()
+		}
+		for i := range names {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+
+		if len(results) > 1 {
+			printBackupSummary(os.Stdout, results)
+		}
+		notifyBackupResults(results)
+
+		failed := 0
+		for _, r := range results {
+			if r.Err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d backup(s) failed", failed, len(results))
+		}
+		return nil
+	},
+}
+
+func init() {
+	f := backupCmd.Flags()
+	f.BoolVar(&backupAll, "all", false, "back up every configured database")
+	f.StringSliceVar(&backupTags, "tag", nil, "back up databases with this tag (repeatable)")
+	f.IntVar(&backupConcurrency, "concurrency", 1, "number of databases to back up at the same time")
+}
+
+// selectDatabases resolves the databases named on the command line, --all
+// and --tag into a sorted list without duplicates.
+func selectDatabases(args []string, all bool, tags []string) ([]string, error) {
+	selected := make(map[string]bool)
+	for _, name := range args {
+		if !viper.IsSet(fmt.Sprintf("databases.%s", name)) {
+			return nil, fmt.Errorf("Database config '%s' not found", name)
+		}
+		selected[name] = true
+	}
+	for _, name := range configuredDatabases() {
+		if all || hasAnyTag(name, tags) {
+			selected[name] = true
+		}
+	}
+
+	if len(selected) == 0 {
+		if len(tags) > 0 {
+			return nil, fmt.Errorf("no database is tagged %s", strings.Join(tags, " or "))
+		}
+		return nil, fmt.Errorf("specify database names, --all or --tag")
+	}
+
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hasAnyTag reports whether databases.<name>.tags contains one of tags
+func hasAnyTag(name string, tags []string) bool {
+	for _, have := range viper.GetStringSlice(fmt.Sprintf("databases.%s.tags", name)) {
+		for _, want := range tags {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backupResult is the outcome of backing up one database
+type backupResult struct {
+	Database string
+	// Manifest is nil if the backup failed
+	Manifest *manifest.Manifest
+	Location string
+	Duration time.Duration
+	Err      error
+	// PruneErr reports a failed auto_prune after a successful backup
+	PruneErr error
+}
+
+// backupDatabase backs up one configured database, logs the outcome and
+// applies auto_prune. It is shared by the backup command and the daemon;
+// callers report the results with notifyBackupResults.
+func backupDatabase(ctx context.Context, dbName string, store core.Storage) (res backupResult) {
+	res.Database = dbName
+	start := time.Now()
+	defer func() {
+		// A bug in one adapter mustn't take down the other backups. Panics
+		// in the dump and upload are already errors from pipeline.Run;
+		// this catches the rest.
+		if r := recover(); r != nil {
+			res.Err = fmt.Errorf("panic: %v", r)
+		}
+		res.Duration = time.Since(start)
+		if res.Err != nil {
+			utils.LogError(fmt.Sprintf("Backup failed for %s: %v", dbName, res.Err))
+		}
+	}()
+
+	utils.LogInfo(fmt.Sprintf("Starting backup for %s", dbName))
+
+	dbConfig, dbAdapter, err := loadDatabase(dbName)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	res.Manifest, res.Location, res.Err = runBackup(ctx, dbName, dbConfig, dbAdapter, store)
+	if res.Err != nil {
+		return res
+	}
+	utils.LogInfo(fmt.Sprintf("Backup successful for %s. Uploaded to: %s", dbName, res.Location))
+
+	if err := autoPrune(ctx, dbName, store); err != nil {
+		res.PruneErr = err
+		utils.LogError(fmt.Sprintf("Pruning old backups of %s failed: %v", dbName, err))
+	}
+	return res
+}
+
+// printBackupSummary prints one row per database
+func printBackupSummary(w io.Writer, results []backupResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tSTATUS\tDURATION\tSIZE\tDETAIL")
+	for _, r := range results {
+		status, size, detail := "ok", "-", r.Location
+		switch {
+		case r.Err != nil:
+			status, detail = "FAILED", r.Err.Error()
+		case r.PruneErr != nil:
+			detail = fmt.Sprintf("%s (prune failed: %v)", r.Location, r.PruneErr)
+		}
+		if r.Manifest != nil {
+			size = formatBytes(r.Manifest.StoredSize)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Database, status, r.Duration.Round(time.Second), size, strings.ReplaceAll(detail, "\n", "; "))
+	}
+	tw.Flush()
+}
+
+// notifyBackupResults sends a single Slack message covering all results
+func notifyBackupResults(results []backupResult) {
+	webhook := viper.GetString("notifications.slack_webhook")
+	if webhook == "" || len(results) == 0 {
+		return
+	}
+
+	var msg strings.Builder
+	if len(results) == 1 {
+		r := results[0]
+		if r.Err != nil {
+			fmt.Fprintf(&msg, "Backup failed for %s: %v", r.Database, r.Err)
+		} else {
+			fmt.Fprintf(&msg, "Backup successful for %s. Uploaded to: %s", r.Database, r.Location)
+		}
+		if r.PruneErr != nil {
+			fmt.Fprintf(&msg, "\nPruning old backups of %s failed: %v", r.Database, r.PruneErr)
+		}
+	} else {
+		failed := 0
+		for _, r := range results {
+			if r.Err != nil {
+				failed++
+			}
+		}
+		fmt.Fprintf(&msg, "Backup of %d databases: %d succeeded, %d failed", len(results), len(results)-failed, failed)
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				fmt.Fprintf(&msg, "\n• %s: FAILED: %v", r.Database, r.Err)
+			case r.PruneErr != nil:
+				fmt.Fprintf(&msg, "\n• %s: ok, %s in %s (prune failed: %v)", r.Database, formatBytes(r.Manifest.StoredSize), r.Duration.Round(time.Second), r.PruneErr)
+			default:
+				fmt.Fprintf(&msg, "\n• %s: ok, %s in %s", r.Database, formatBytes(r.Manifest.StoredSize), r.Duration.Round(time.Second))
+			}
+		}
+	}
+
+	if err := utils.SendSlackNotification(webhook, msg.String()); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to send Slack notification: %v", err))
+	}
+}
+
+// autoPrune applies the database's retention policy after a successful
+// backup if the policy has auto_prune set.
+func autoPrune(ctx context.Context, dbName string, store core.Storage) error {
+	policy, err := retentionPolicy(dbName)
+	if err != nil {
+		return err
+	}
+	if !policy.AutoPrune || policy.IsZero() {
+		return nil
+	}
+
+	manifests, err := manifest.List(ctx, store, remotePath(dbName))
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %v", err)
+	}
+	var backups []*manifest.Manifest
+	for _, m := range manifests {
+		if m.Database == dbName {
+			backups = append(backups, m)
+		}
+	}
+
+	var out strings.Builder
+	removed, err := pruneBackups(ctx, &out, store, backups, policy, false)
+	utils.LogInfo(fmt.Sprintf("Retention policy for %s:\n%s", dbName, out.String()))
+	if removed > 0 {
+		utils.LogInfo(fmt.Sprintf("Removed %d old backup(s) of %s", removed, dbName))
+	}
+	return err
+}
+
+// runBackup dumps one database into storage and writes its manifest next to
+// the artifact. It returns the manifest and the location reported by the
+// storage backend.
+func runBackup(ctx context.Context, dbName string, dbConfig core.Config, db core.Database, store core.Storage) (*manifest.Manifest, string, error) {
+	encCfg, err := encryptionConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	enc, err := encCfg.Encrypter()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load encryption key: %v", err)
+	}
+
+	dbType := dbConfig["type"].(string)
+	m := newManifest(dbName, dbType)
+
+	ext := "sql"
+	if dbType == "sqlite" {
+		ext = "db"
+	}
+	if d, ok := db.(core.DumpExtDatabase); ok {
+		ext = d.DumpExt(dbConfig)
+	}
+	name := fmt.Sprintf("%s.%s.gz", m.ID, ext)
+	m.Compression = "gzip"
+	if enc != nil {
+		name += enc.Ext()
+		m.Encryption = enc.Method()
+		m.EncryptionParams = enc.Params()
+	}
+	m.Artifact = remotePath(dbName, name)
+
+	// Globals are small and dumped first, so that a failure doesn't leave
+	// a large orphaned artifact behind.
+	if gdb, ok := db.(core.GlobalsDatabase); ok && gdb.WantsGlobals(dbConfig) {
+		globalsName := fmt.Sprintf("%s.globals.sql.gz", m.ID)
+		if enc != nil {
+			globalsName += enc.Ext()
+		}
+		m.Globals, err = backupGlobals(ctx, gdb, dbConfig, store, enc, remotePath(dbName, globalsName))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Stream dump -> gzip -> encryption -> storage when both adapters
+	// support it, otherwise fall back to staging the dump in local files.
+	var uploadedPath string
+	streamDB, dbStreams := db.(core.StreamingDatabase)
+	streamStorage, storageStreams := store.(core.StreamingStorage)
+	if dbStreams && storageStreams {
+		uploadedPath, err = streamBackup(ctx, streamDB, dbConfig, streamStorage, enc, m)
+	} else {
+		uploadedPath, err = fileBackup(ctx, db, dbConfig, store, enc, m)
+	}
+	if err != nil {
+		if m.Globals != nil {
+			store.Delete(context.WithoutCancel(ctx), m.Globals.Artifact)
+		}
+		return nil, "", err
+	}
+	m.EndTime = time.Now().UTC()
+
+	if err := manifest.Write(ctx, store, m); err != nil {
+		return nil, "", err
+	}
+	return m, uploadedPath, nil
+}
+
+// newManifest starts the manifest of a backup taken now
+func newManifest(dbName, dbType string) *manifest.Manifest {
+	start := time.Now().UTC()
+	hostname, _ := os.Hostname()
+	return &manifest.Manifest{
+		ID:           fmt.Sprintf("%s-%s", dbName, start.Format("20060102T150405Z")),
+		Database:     dbName,
+		DatabaseType: dbType,
+		StartTime:    start,
+		ToolVersion:  version,
+		Hostname:     hostname,
+	}
+}
+
+// streamBackup pipes the dump through compression and, if enc is set,
+// encryption straight into storage without writing anything to local disk.
+// Sizes and the checksum are measured on the fly and recorded in m.
+func streamBackup(ctx context.Context, db core.StreamingDatabase, dbConfig core.Config, store core.StreamingStorage, enc encryption.Encrypter, m *manifest.Manifest) (string, error) {
+	var (
+		uploadedPath string
+		raw, stored  pipeline.Counter
+		hash         = sha256.New()
+	)
+
+	produce := func(ctx context.Context, w io.Writer) error {
+		info, err := db.BackupTo(ctx, dbConfig, io.MultiWriter(w, &raw))
+		m.ServerVersion = info.ServerVersion
+		m.DumpToolVersion = info.DumpToolVersion
+		m.Metadata = info.Metadata
+		return err
+	}
+	stages := []pipeline.Stage{utils.NewCompressWriter}
+	if enc != nil {
+		stages = append(stages, enc.NewWriter)
+	}
+	consume := func(ctx context.Context, r io.Reader) error {
+		var err error
+		uploadedPath, err = store.UploadStream(ctx, io.TeeReader(r, io.MultiWriter(hash, &stored)), m.Artifact)
+		return err
+	}
+
+	if err := pipeline.Run(ctx, produce, stages, consume); err != nil {
+		return "", err
+	}
+
+	m.RawSize = raw.N
+	m.StoredSize = stored.N
+	m.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return uploadedPath, nil
+}
+
+// backupGlobals pipes the server-wide objects through compression and
+// encryption into storage at path.
+func backupGlobals(ctx context.Context, db core.GlobalsDatabase, dbConfig core.Config, store core.Storage, enc encryption.Encrypter, path string) (*manifest.Part, error) {
+	var (
+		raw, stored pipeline.Counter
+		hash        = sha256.New()
+	)
+
+	produce := func(ctx context.Context, w io.Writer) error {
+		return db.BackupGlobalsTo(ctx, dbConfig, io.MultiWriter(w, &raw))
+	}
+	stages := []pipeline.Stage{utils.NewCompressWriter}
+	if enc != nil {
+		stages = append(stages, enc.NewWriter)
+	}
+	consume := func(ctx context.Context, r io.Reader) error {
+		_, err := storage.Put(ctx, store, io.TeeReader(r, io.MultiWriter(hash, &stored)), path)
+		return err
+	}
+
+	if err := pipeline.Run(ctx, produce, stages, consume); err != nil {
+		return nil, err
+	}
+	return &manifest.Part{
+		Artifact:   path,
+		RawSize:    raw.N,
+		StoredSize: stored.N,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// fileBackup dumps to a local file, compresses and encrypts it and uploads
+// the result.
+func fileBackup(ctx context.Context, db core.Database, dbConfig core.Config, store core.Storage, enc encryption.Encrypter, m *manifest.Manifest) (string, error) {
+	backupPath, err := db.Backup(ctx, dbConfig, fmt.Sprintf("temp_%s", m.ID))
+	if err != nil {
+		return "", err
+	}
+	utils.LogInfo(fmt.Sprintf("Database backed up locally to: %s", backupPath))
+
+	if fi, err := os.Stat(backupPath); err == nil {
+		m.RawSize = fi.Size()
+	}
+
+	// Compress
+	compressedPath, err := utils.CompressFile(backupPath)
+	os.Remove(backupPath)
+	if err != nil {
+		return "", fmt.Errorf("compression failed: %v", err)
+	}
+	defer os.Remove(compressedPath)
+	utils.LogInfo(fmt.Sprintf("Backup compressed to: %s", compressedPath))
+
+	uploadPath := compressedPath
+	if enc != nil {
+		if uploadPath, err = encryptFile(compressedPath, enc); err != nil {
+			return "", fmt.Errorf("encryption failed: %v", err)
+		}
+		defer os.Remove(uploadPath)
+	}
+
+	f, err := os.Open(uploadPath)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	m.StoredSize, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	m.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	// Upload
+	uploadedPath, err := store.Upload(ctx, uploadPath, m.Artifact)
+	if err != nil {
+		return "", fmt.Errorf("upload failed: %v", err)
+	}
+	return uploadedPath, nil
+}
+
+// encryptFile writes an encrypted copy of path to path + ".enc"
+func encryptFile(path string, enc encryption.Encrypter) (string, error) {
+	destPath := path + ".enc"
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(destPath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	ew, err := enc.NewWriter(dst)
+	if err == nil {
+		if _, err = io.Copy(ew, src); err == nil {
+			err = ew.Close()
+		}
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(destPath)
+		return "", err
+	}
+	return destPath, nil
+}
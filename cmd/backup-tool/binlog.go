@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/databases"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/manifest"
+	"db-backup-tool/pkg/utils"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// binlogConfig is the typed form of databases.<name>.binlog
+type binlogConfig struct {
+	// Enabled archives the binlogs while the daemon runs
+	Enabled bool `mapstructure:"enabled"`
+	// UploadInterval is how often the binlog being written is uploaded,
+	// which bounds how much is lost if the host goes away.
+	UploadInterval time.Duration `mapstructure:"upload_interval"`
+	// ServerID is the replica server ID mysqlbinlog connects with
+	ServerID int `mapstructure:"server_id"`
+}
+
+func parseBinlogConfig(dbName string) (*binlogConfig, error) {
+	key := fmt.Sprintf("databases.%s.binlog", dbName)
+	cfg := &binlogConfig{UploadInterval: time.Minute}
+	if !viper.IsSet(key) {
+		return cfg, nil
+	}
+	if err := core.DecodeConfig(core.Config(viper.GetStringMap(key)), cfg); err != nil {
+		return nil, core.PrefixFieldErrors(key, err)
+	}
+
+	var errs []error
+	if t := viper.GetString(fmt.Sprintf("databases.%s.type", dbName)); t != "mysql" {
+		errs = append(errs, &core.FieldError{Field: key, Msg: "is only supported for mysql databases"})
+	}
+	if cfg.UploadInterval <= 0 {
+		errs = append(errs, &core.FieldError{Field: key + ".upload_interval", Msg: "must be positive"})
+	}
+	if cfg.ServerID < 0 {
+		errs = append(errs, &core.FieldError{Field: key + ".server_id", Msg: "must not be negative"})
+	}
+	return cfg, errors.Join(errs...)
+}
+
+var binlogStartFile string
+
+var binlogCmd = &cobra.Command{
+	Use:   "binlog [db_name]",
+	Short: "Continuously archive MySQL binary logs",
+	Long: `Pull the binary logs of a MySQL database with mysqlbinlog and upload them
+to storage, compressed and encrypted like backups, for point-in-time
+recovery with "restore --to-time".
+
+Archiving resumes with the newest archived binlog, or starts with the binlog
+recorded by the newest backup (see source_data). The binlog being written is
+uploaded up to its last complete event every binlog.upload_interval. Runs
+until SIGTERM or Ctrl-C; the daemon does the same for databases with
+binlog.enabled.`,
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbName := args[0]
+		cfg, err := parseBinlogConfig(dbName)
+		if err != nil {
+			return err
+		}
+
+		// Not bounded by --timeout, this runs until it is stopped.
+		ctx := cmd.Context()
+		store, err := getStorageAdapter(ctx)
+		if err != nil {
+			return err
+		}
+		return archiveBinlogs(ctx, dbName, cfg, store, binlogStartFile)
+	},
+}
+
+func init() {
+	binlogCmd.Flags().StringVar(&binlogStartFile, "start-file", "", "binlog to start with if none has been archived yet, e.g. binlog.000042")
+	rootCmd.AddCommand(binlogCmd)
+}
+
+// binlogPrefix is where the binlogs of a database are archived
+func binlogPrefix(dbName string) string {
+	return remotePath(dbName, "binlog")
+}
+
+// archiveBinlogs streams the binlogs of dbName into storage until ctx is
+// cancelled.
+func archiveBinlogs(ctx context.Context, dbName string, cfg *binlogConfig, store core.Storage, startFile string) error {
+	dbConfig, dbAdapter, err := loadDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	mysql, ok := dbAdapter.(*databases.MySQLDatabase)
+	if !ok {
+		return fmt.Errorf("binlog archiving is only supported for mysql databases, %s is %s", dbName, dbConfig["type"])
+	}
+
+	encCfg, err := encryptionConfig()
+	if err != nil {
+		return err
+	}
+	enc, err := encCfg.Encrypter()
+	if err != nil {
+		return fmt.Errorf("failed to load encryption key: %v", err)
+	}
+
+	if startFile, err = binlogStartPoint(ctx, dbName, store, startFile); err != nil {
+		return err
+	}
+
+	spool, err := os.MkdirTemp("", "binlog-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(spool)
+
+	a := &binlogArchiver{dbName: dbName, store: store, enc: enc, spool: spool, uploaded: map[string]int64{}}
+	utils.LogInfo(fmt.Sprintf("Archiving binlogs of %s starting with %s", dbName, startFile))
+
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- mysql.StreamBinlogs(ctx, dbConfig, spool, startFile, cfg.ServerID)
+	}()
+
+	ticker := time.NewTicker(cfg.UploadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.sync(ctx); err != nil {
+				utils.LogError(fmt.Sprintf("Failed to upload binlogs of %s: %v", dbName, err))
+			}
+		case err := <-streamErr:
+			// Upload what was received before stopping, even on shutdown.
+			if serr := a.sync(context.WithoutCancel(ctx)); serr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to upload binlogs: %v", serr))
+			}
+			if err == nil {
+				utils.LogInfo(fmt.Sprintf("Stopped archiving binlogs of %s", dbName))
+			}
+			return err
+		}
+	}
+}
+
+// binlogStartPoint picks the binlog to start streaming with: the newest one
+// archived, which may be incomplete and is fetched again, else the one
+// recorded by the newest backup, else startFile.
+func binlogStartPoint(ctx context.Context, dbName string, store core.Storage, startFile string) (string, error) {
+	archived, err := listBinlogs(ctx, dbName, store)
+	if err != nil {
+		return "", err
+	}
+	if len(archived) > 0 {
+		return archived[len(archived)-1].name, nil
+	}
+
+	manifests, err := manifest.List(ctx, store, remotePath(dbName))
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups: %v", err)
+	}
+	for i := len(manifests) - 1; i >= 0; i-- {
+		if f := manifests[i].Metadata["binlog_file"]; f != "" && manifests[i].Database == dbName {
+			return f, nil
+		}
+	}
+
+	if startFile == "" {
+		return "", fmt.Errorf("no binlogs of %s archived and no backup records a binlog position; take a backup with source_data enabled, the default, or give --start-file", dbName)
+	}
+	return startFile, nil
+}
+
+// listBinlogs returns the archived binlogs of dbName in order. The numeric
+// suffix of binlog names is zero-padded, so they sort by name.
+func listBinlogs(ctx context.Context, dbName string, store core.Storage) ([]archivedFile, error) {
+	binlogs, err := listArchived(ctx, store, binlogPrefix(dbName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list binlogs: %v", err)
+	}
+	return binlogs, nil
+}
+
+// binlogArchiver uploads the binlogs mysqlbinlog writes to a spool directory
+type binlogArchiver struct {
+	dbName string
+	store  core.Storage
+	enc    encryption.Encrypter
+	spool  string
+	// uploaded is how much of each binlog was last uploaded
+	uploaded map[string]int64
+}
+
+// sync uploads the binlogs that have grown since the last sync. The newest
+// binlog is still being written and is only uploaded up to its last
+// complete event. Complete binlogs, all but the newest, are removed from the
+// spool once uploaded.
+func (a *binlogArchiver) sync(ctx context.Context) error {
+	entries, err := os.ReadDir(a.spool)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts by name.
+	for i, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		size := fi.Size()
+		if i == len(entries)-1 {
+			size, err = databases.BinlogCompleteSize(filepath.Join(a.spool, e.Name()), a.uploaded[e.Name()])
+			if err != nil {
+				return err
+			}
+		}
+		if size != a.uploaded[e.Name()] {
+			if err := a.upload(ctx, e.Name(), size); err != nil {
+				return err
+			}
+			a.uploaded[e.Name()] = size
+		}
+		if i < len(entries)-1 {
+			os.Remove(filepath.Join(a.spool, e.Name()))
+			delete(a.uploaded, e.Name())
+		}
+	}
+	return nil
+}
+
+// upload stores the first size bytes of a spooled binlog, replacing any
+// earlier upload of it.
+func (a *binlogArchiver) upload(ctx context.Context, name string, size int64) error {
+	f, err := os.Open(filepath.Join(a.spool, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	produce := func(ctx context.Context, w io.Writer) error {
+		_, err := io.Copy(w, io.LimitReader(f, size))
+		return err
+	}
+	if err := archiveStream(ctx, a.store, a.enc, produce, archivedPath(binlogPrefix(a.dbName), name, a.enc)); err != nil {
+		return err
+	}
+	utils.LogInfo(fmt.Sprintf("Uploaded binlog %s of %s up to position %d", name, a.dbName, size))
+	return nil
+}
+
+// replayBinlogs downloads the archived binlogs from the position recorded
+// by m on and replays them up to stop.
+func replayBinlogs(ctx context.Context, store core.Storage, m *manifest.Manifest, stop time.Time, kr *encryption.Keyring, db *databases.MySQLDatabase, dbConfig core.Config, opts core.RestoreOptions) error {
+	startFile, startPos := m.Metadata["binlog_file"], m.Metadata["binlog_position"]
+
+	archived, err := listBinlogs(ctx, m.Database, store)
+	if err != nil {
+		return err
+	}
+	var needed []archivedFile
+	for _, b := range archived {
+		if b.name >= startFile {
+			needed = append(needed, b)
+		}
+	}
+	if len(needed) == 0 || needed[0].name != startFile {
+		return fmt.Errorf("binlog %s, recorded by backup %s, has not been archived", startFile, m.ID)
+	}
+	for i := 1; i < len(needed); i++ {
+		if !consecutiveBinlogs(needed[i-1].name, needed[i].name) {
+			return fmt.Errorf("the binlogs between %s and %s are missing from the archive", needed[i-1].name, needed[i].name)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "binlog-replay-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("Downloading %d binlog(s) from %s...\n", len(needed), startFile)
+	files := make([]string, len(needed))
+	for i, b := range needed {
+		files[i] = filepath.Join(dir, b.name)
+		if err := fetchArchived(ctx, store, b.path, files[i], kr); err != nil {
+			return fmt.Errorf("Download of binlog %s failed: %v", b.name, err)
+		}
+	}
+
+	fmt.Printf("Replaying binlogs from %s:%s up to %s...\n", startFile, startPos, stop.Local().Format(time.RFC3339))
+	if err := db.ReplayBinlogs(ctx, dbConfig, files, startPos, stop, opts); err != nil {
+		return fmt.Errorf("Point-in-time recovery failed: %v", err)
+	}
+	return nil
+}
+
+// consecutiveBinlogs reports whether binlog b directly follows a, e.g.
+// binlog.000042 and binlog.000043.
+func consecutiveBinlogs(a, b string) bool {
+	i, j := strings.LastIndex(a, "."), strings.LastIndex(b, ".")
+	if i < 0 || j < 0 || a[:i] != b[:j] {
+		return false
+	}
+	n, errA := strconv.Atoi(a[i+1:])
+	m, errB := strconv.Atoi(b[j+1:])
+	return errA == nil && errB == nil && m == n+1
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"db-backup-tool/pkg/core"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration file",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:           "validate",
+	Short:         "Check the whole configuration file for errors",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if configErr != nil {
+			return fmt.Errorf("failed to read config file: %v", configErr)
+		}
+
+		errs := validateConfig()
+		if len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Println(err)
+			}
+			return fmt.Errorf("%s: %d problem(s) found", viper.ConfigFileUsed(), len(errs))
+		}
+
+		fmt.Printf("%s: OK (%d database(s))\n", viper.ConfigFileUsed(), len(configuredDatabases()))
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+// validateConfig checks every section of the config file and returns one
+// error per problem.
+func validateConfig() []error {
+	var errs []error
+
+	switch storageType := viper.GetString("storage.type"); storageType {
+	case "":
+		errs = append(errs, &core.FieldError{Field: "storage.type", Msg: "is required"})
+	case "local":
+		if viper.GetString("storage.path") == "" {
+			errs = append(errs, &core.FieldError{Field: "storage.path", Msg: "is required for local storage"})
+		}
+	case "s3", "gcs":
+		if viper.GetString("storage.bucket") == "" {
+			errs = append(errs, &core.FieldError{Field: "storage.bucket", Msg: fmt.Sprintf("is required for %s storage", storageType)})
+		}
+	default:
+		errs = append(errs, &core.FieldError{Field: "storage.type", Msg: fmt.Sprintf("unsupported storage type %q", storageType)})
+	}
+
+	if webhook := viper.GetString("notifications.slack_webhook"); webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, &core.FieldError{Field: "notifications.slack_webhook", Msg: "must be an http(s) URL"})
+		}
+	}
+
+	if _, err := parseRetention("retention"); err != nil {
+		errs = append(errs, splitErrors(err)...)
+	}
+
+	if encCfg, err := encryptionConfig(); err != nil {
+		errs = append(errs, splitErrors(err)...)
+	} else {
+		_, encErr := encCfg.Encrypter()
+		if encErr != nil {
+			errs = append(errs, &core.FieldError{Field: "encryption", Msg: encErr.Error()})
+		}
+		// The keyring repeats the current AES key, don't report it twice.
+		if _, err := encCfg.Keyring(); err != nil && (encErr == nil || err.Error() != encErr.Error()) {
+			errs = append(errs, &core.FieldError{Field: "encryption", Msg: err.Error()})
+		}
+	}
+
+	if _, err := parseDaemonConfig(); err != nil {
+		errs = append(errs, splitErrors(err)...)
+	}
+
+	names := configuredDatabases()
+	if len(names) == 0 {
+		errs = append(errs, &core.FieldError{Field: "databases", Msg: "at least one database must be configured"})
+	}
+	for _, name := range names {
+		if _, _, err := loadDatabase(name); err != nil {
+			errs = append(errs, splitErrors(err)...)
+		}
+		if _, err := parseSchedule(name); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := parseBinlogConfig(name); err != nil {
+			errs = append(errs, splitErrors(err)...)
+		}
+		if _, err := parseOplogArchiveConfig(name); err != nil {
+			errs = append(errs, splitErrors(err)...)
+		}
+		if key := fmt.Sprintf("databases.%s.retention", name); viper.IsSet(key) {
+			if _, err := parseRetention(key); err != nil {
+				errs = append(errs, splitErrors(err)...)
+			}
+		}
+	}
+
+	return errs
+}
+
+// splitErrors expands an errors.Join result so each problem prints on its own
+// line.
+func splitErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/manifest"
+	"db-backup-tool/pkg/utils"
+
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// daemonConfig is the typed form of the daemon section of the config file
+type daemonConfig struct {
+	// Jitter delays each run by a random duration up to this long, so
+	// that many databases (or hosts) on the same schedule don't all hit
+	// storage at once.
+	Jitter time.Duration `mapstructure:"jitter"`
+	// CatchUp is "once" to run a single backup at startup if scheduled
+	// runs were missed while the daemon was down, or "none".
+	CatchUp string `mapstructure:"catch_up"`
+	// ShutdownTimeout bounds how long running backups may take to finish
+	// after SIGTERM; 0 waits for them indefinitely.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+}
+
+func parseDaemonConfig() (*daemonConfig, error) {
+	cfg := &daemonConfig{CatchUp: "once"}
+	if err := core.DecodeConfig(core.Config(viper.GetStringMap("daemon")), cfg); err != nil {
+		return nil, core.PrefixFieldErrors("daemon", err)
+	}
+
+	var errs []error
+	if cfg.Jitter < 0 {
+		errs = append(errs, &core.FieldError{Field: "daemon.jitter", Msg: "must not be negative"})
+	}
+	if cfg.CatchUp != "once" && cfg.CatchUp != "none" {
+		errs = append(errs, &core.FieldError{Field: "daemon.catch_up", Msg: `must be "once" or "none"`})
+	}
+	if cfg.ShutdownTimeout < 0 {
+		errs = append(errs, &core.FieldError{Field: "daemon.shutdown_timeout", Msg: "must not be negative"})
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// parseSchedule parses databases.<name>.schedule. It returns a nil schedule
+// if the database has none.
+func parseSchedule(dbName string) (cron.Schedule, error) {
+	key := fmt.Sprintf("databases.%s.schedule", dbName)
+	spec := viper.GetString(key)
+	if spec == "" {
+		return nil, nil
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, &core.FieldError{Field: key, Msg: err.Error()}
+	}
+	return schedule, nil
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run scheduled backups",
+	Long: `Run in the foreground and back up every database that has a "schedule"
+(a cron expression such as "0 */6 * * *") whenever it is due. The binlogs of
+MySQL databases with binlog.enabled, and the oplog of MongoDB databases with
+oplog_archive.enabled, are archived continuously, like the binlog and oplog
+commands do.
+
+A run is skipped if the previous backup of the same database is still going.
+On SIGTERM or Ctrl-C no new backups are started and running ones are allowed
+to finish; a second signal aborts them.`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := parseDaemonConfig()
+		if err != nil {
+			return err
+		}
+
+		// Backups run under their own context so that the first signal,
+		// which cancels cmd.Context(), lets them finish.
+		runCtx, abort := context.WithCancel(context.Background())
+		defer abort()
+
+		store, err := getStorageAdapter(runCtx)
+		if err != nil {
+			return err
+		}
+
+		d := &daemon{cfg: cfg, store: store, stopping: cmd.Context().Done(), runCtx: runCtx}
+		c := cron.New()
+		scheduled, archiving := 0, 0
+		for _, name := range configuredDatabases() {
+			binlogCfg, err := parseBinlogConfig(name)
+			if err != nil {
+				return err
+			}
+			if binlogCfg.Enabled {
+				d.keepArchiving(cmd.Context(), "Binlog", name, func(ctx context.Context) error {
+					return archiveBinlogs(ctx, name, binlogCfg, d.store, "")
+				})
+				archiving++
+			}
+			oplogCfg, err := parseOplogArchiveConfig(name)
+			if err != nil {
+				return err
+			}
+			if oplogCfg.Enabled {
+				d.keepArchiving(cmd.Context(), "Oplog", name, func(ctx context.Context) error {
+					return archiveOplog(ctx, name, oplogCfg, d.store)
+				})
+				archiving++
+			}
+
+			schedule, err := parseSchedule(name)
+			if err != nil {
+				return err
+			}
+			if schedule == nil {
+				continue
+			}
+
+			job := cron.NewChain(cron.SkipIfStillRunning(cronLogger{name})).Then(cron.FuncJob(func() { d.run(name) }))
+			c.Schedule(schedule, job)
+			scheduled++
+			utils.LogInfo(fmt.Sprintf("Scheduled %s: %s, next run at %s", name, viper.GetString(fmt.Sprintf("databases.%s.schedule", name)), schedule.Next(time.Now()).Format(time.RFC3339)))
+
+			if cfg.CatchUp == "once" {
+				d.catchUp(name, schedule, job)
+			}
+		}
+		if scheduled == 0 && archiving == 0 {
+			return errors.New("no database has a schedule or binlog or oplog archiving enabled")
+		}
+
+		c.Start()
+		utils.LogInfo(fmt.Sprintf("Daemon started with %d scheduled database(s) and log archiving for %d", scheduled, archiving))
+
+		<-cmd.Context().Done()
+		utils.LogInfo("Shutting down, waiting for running backups to finish")
+
+		// A second signal aborts the running backups.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+
+		var deadline <-chan time.Time
+		if cfg.ShutdownTimeout > 0 {
+			deadline = time.After(cfg.ShutdownTimeout)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			<-c.Stop().Done()
+			// Catch-up runs and log archivers aren't tracked by the
+			// scheduler.
+			d.wg.Wait()
+			close(done)
+		}()
+
+		for {
+			select {
+			case <-done:
+				utils.LogInfo("Daemon stopped")
+				return nil
+			case <-sigs:
+				utils.LogError("Second signal received, aborting running backups")
+				abort()
+			case <-deadline:
+				utils.LogError("Shutdown timeout reached, aborting running backups")
+				abort()
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+}
+
+type daemon struct {
+	cfg   *daemonConfig
+	store core.Storage
+	// stopping is closed once shutdown begins
+	stopping <-chan struct{}
+	// runCtx is only cancelled to abort running backups
+	runCtx context.Context
+	wg     sync.WaitGroup
+}
+
+// run backs up one database after a random jitter delay
+func (d *daemon) run(dbName string) {
+	if d.cfg.Jitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(d.cfg.Jitter)))
+		select {
+		case <-time.After(delay):
+		case <-d.stopping:
+			return
+		}
+	}
+	select {
+	case <-d.stopping:
+		return
+	default:
+	}
+
+	ctx := d.runCtx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	notifyBackupResults([]backupResult{backupDatabase(ctx, dbName, d.store)})
+}
+
+// catchUp starts job right away if a scheduled run was missed since the
+// database's last backup. Databases that were never backed up aren't caught
+// up; their first backup happens on schedule.
+func (d *daemon) catchUp(dbName string, schedule cron.Schedule, job cron.Job) {
+	manifests, err := manifest.List(d.runCtx, d.store, remotePath(dbName))
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Can't check for missed runs of %s: %v", dbName, err))
+		return
+	}
+
+	var last time.Time
+	for _, m := range manifests {
+		if m.Database == dbName && m.StartTime.After(last) {
+			last = m.StartTime
+		}
+	}
+	if last.IsZero() || !schedule.Next(last).Before(time.Now()) {
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("Missed scheduled run of %s since last backup at %s, catching up", dbName, last.Local().Format(time.RFC3339)))
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		job.Run()
+	}()
+}
+
+// archiveRetryDelay is how long a failed log archiver waits before it
+// starts again
+const archiveRetryDelay = time.Minute
+
+// keepArchiving runs archive, which archives the binlogs or oplog of dbName,
+// in the background until shutdown, restarting it after failures.
+func (d *daemon) keepArchiving(ctx context.Context, what, dbName string, archive func(context.Context) error) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			err := archive(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			utils.LogError(fmt.Sprintf("%s archiving of %s stopped, retrying in %s: %v", what, dbName, archiveRetryDelay, err))
+			select {
+			case <-time.After(archiveRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// cronLogger reports runs skipped by cron.SkipIfStillRunning
+type cronLogger struct {
+	dbName string
+}
+
+func (l cronLogger) Info(msg string, keysAndValues ...interface{}) {
+	if msg == "skip" {
+		utils.LogInfo(fmt.Sprintf("Skipping scheduled backup of %s, the previous one is still running", l.dbName))
+	}
+}
+
+func (l cronLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	utils.LogError(fmt.Sprintf("%s: %s: %v", l.dbName, msg, err))
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+)
+
+// initOptions holds the values substituted into the generated config file
+type initOptions struct {
+	Name     string
+	Type     string
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+	Path     string
+
+	StorageType string
+	StoragePath string
+	Bucket      string
+	Region      string
+
+	SlackWebhook string
+}
+
+var (
+	initOpts        initOptions
+	initInteractive bool
+	initForce       bool
+	// initPasswordEnv names the environment variable holding the password,
+	// which would be visible to other users in ps as a flag value.
+	initPasswordEnv string
+)
+
+var defaultPorts = map[string]int{
+	"mysql":    3306,
+	"postgres": 5432,
+	"mongo":    27017,
+	"redis":    6379,
+}
+
+var defaultUsers = map[string]string{
+	"mysql":    "root",
+	"postgres": "postgres",
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate a commented db_backup_config.yaml",
+	Long: `Generate a commented configuration file covering every supported database,
+storage backend and notification option.
+
+Values come from flags (for CI) or, with --interactive, from prompts. The
+password is read from the environment variable named by --password-env:
+
+  DB_PASSWORD=... backup-tool init --type postgres --password-env DB_PASSWORD`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := cfgFile
+		if path == "" {
+			path = "db_backup_config.yaml"
+		}
+
+		if _, err := os.Stat(path); err == nil && !initForce {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+
+		opts := initOpts
+		if initPasswordEnv != "" {
+			opts.Password = os.Getenv(initPasswordEnv)
+			if opts.Password == "" {
+				return fmt.Errorf("environment variable %s is not set", initPasswordEnv)
+			}
+		}
+		if initInteractive {
+			if err := promptInitOptions(cmd.InOrStdin(), cmd.OutOrStdout(), &opts); err != nil {
+				return err
+			}
+		}
+		if err := completeInitOptions(&opts); err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := configTemplate.Execute(&buf, opts); err != nil {
+			return fmt.Errorf("failed to render config: %v", err)
+		}
+
+		// The file holds database credentials, so keep it private.
+		if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Configuration written to %s\n", path)
+		return nil
+	},
+}
+
+func init() {
+	f := initCmd.Flags()
+	f.BoolVarP(&initInteractive, "interactive", "i", false, "prompt for each setting")
+	f.BoolVar(&initForce, "force", false, "overwrite an existing config file")
+
+	f.StringVar(&initOpts.Name, "name", "my_db", "name of the database entry")
+	f.StringVar(&initOpts.Type, "type", "mysql", "database type: mysql, postgres, mongo, redis or sqlite")
+	f.StringVar(&initOpts.Host, "host", "localhost", "database host")
+	f.IntVar(&initOpts.Port, "port", 0, "database port (default depends on --type)")
+	f.StringVar(&initOpts.User, "user", "", "database user")
+	f.StringVar(&initPasswordEnv, "password-env", "", "environment variable holding the database password")
+	f.StringVar(&initOpts.Database, "database", "", "database name")
+	f.StringVar(&initOpts.Path, "path", "", "database file (sqlite only)")
+
+	f.StringVar(&initOpts.StorageType, "storage", "local", "storage backend: local, s3 or gcs")
+	f.StringVar(&initOpts.StoragePath, "storage-path", "./backups", "directory or key prefix for backups")
+	f.StringVar(&initOpts.Bucket, "bucket", "", "bucket name (s3/gcs)")
+	f.StringVar(&initOpts.Region, "region", "us-east-1", "bucket region (s3)")
+
+	f.StringVar(&initOpts.SlackWebhook, "slack-webhook", "", "Slack incoming webhook URL")
+}
+
+// promptInitOptions asks for each setting, offering the current value as the
+// default.
+func promptInitOptions(in io.Reader, out io.Writer, opts *initOptions) error {
+	r := bufio.NewReader(in)
+	ask := func(label, def string) (string, error) {
+		if def != "" {
+			fmt.Fprintf(out, "%s [%s]: ", label, def)
+		} else {
+			fmt.Fprintf(out, "%s: ", label)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+		return def, nil
+	}
+
+	var err error
+	prompt := func(label string, dst *string) {
+		if err == nil {
+			*dst, err = ask(label, *dst)
+		}
+	}
+
+	prompt("Database name", &opts.Name)
+	prompt("Database type (mysql, postgres, mongo, redis, sqlite)", &opts.Type)
+	if opts.Type == "sqlite" {
+		prompt("Database file", &opts.Path)
+	} else {
+		port := ""
+		if p := opts.Port; p != 0 {
+			port = strconv.Itoa(p)
+		} else if p, ok := defaultPorts[opts.Type]; ok {
+			port = strconv.Itoa(p)
+		}
+
+		if opts.User == "" {
+			opts.User = defaultUsers[opts.Type]
+		}
+
+		prompt("Host", &opts.Host)
+		prompt("Port", &port)
+		prompt("User", &opts.User)
+		prompt("Password", &opts.Password)
+		if opts.Type != "redis" {
+			prompt("Database", &opts.Database)
+		}
+		if err == nil && port != "" {
+			if opts.Port, err = strconv.Atoi(port); err != nil {
+				return fmt.Errorf("invalid port %q", port)
+			}
+		}
+	}
+
+	prompt("Storage (local, s3, gcs)", &opts.StorageType)
+	prompt("Backup directory / key prefix", &opts.StoragePath)
+	if opts.StorageType == "s3" || opts.StorageType == "gcs" {
+		prompt("Bucket", &opts.Bucket)
+	}
+	if opts.StorageType == "s3" {
+		prompt("Region", &opts.Region)
+	}
+	prompt("Slack webhook URL (optional)", &opts.SlackWebhook)
+
+	return err
+}
+
+// completeInitOptions checks the chosen values and fills in defaults that
+// depend on other settings.
+func completeInitOptions(opts *initOptions) error {
+	switch opts.Type {
+	case "sqlite":
+		if opts.Path == "" {
+			opts.Path = "./app.db"
+		}
+	case "mysql", "postgres", "mongo":
+		if opts.Port == 0 {
+			opts.Port = defaultPorts[opts.Type]
+		}
+		if opts.User == "" {
+			opts.User = defaultUsers[opts.Type]
+		}
+		if opts.Database == "" {
+			opts.Database = opts.Name
+		}
+	case "redis":
+		// Backups hold the whole server, and users are optional.
+		if opts.Port == 0 {
+			opts.Port = defaultPorts[opts.Type]
+		}
+	default:
+		return fmt.Errorf("unsupported database type: %s", opts.Type)
+	}
+
+	switch opts.StorageType {
+	case "local":
+	case "s3", "gcs":
+		if opts.Bucket == "" {
+			opts.Bucket = "my-backup-bucket"
+		}
+	default:
+		return fmt.Errorf("unsupported storage type: %s", opts.StorageType)
+	}
+	return nil
+}
+
+var configTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`# backup-tool configuration
+#
+# Check this file with:  backup-tool config validate
+# Test connections with: backup-tool test --all
+
+# Where backups are stored.
+storage:
+  # Backend: local, s3 or gcs
+  type: {{.StorageType}}
+  # Directory (local) or object key prefix (s3/gcs) for backup files
+  path: {{quote .StoragePath}}
+{{- if eq .StorageType "local"}}
+  # bucket: my-backup-bucket    # s3/gcs: bucket name
+  # region: us-east-1           # s3: bucket region
+{{- else}}
+  bucket: {{quote .Bucket}}
+{{- if eq .StorageType "s3"}}
+  region: {{quote .Region}}
+{{- end}}
+{{- end}}
+  # endpoint: http://localhost:9000    # s3/gcs: custom endpoint (MinIO, fake-gcs-server)
+  # use_path_style: true               # s3: needed by most S3-compatible servers
+
+# Optional notifications on backup success/failure.
+notifications:
+{{- if .SlackWebhook}}
+  slack_webhook: {{quote .SlackWebhook}}
+{{- else}}
+  # slack_webhook: "https://hooks.slack.com/services/..."
+{{- end}}
+
+# How many backups to keep, applied by "backup-tool prune". A database can
+# override this with its own retention section. Without any rules nothing
+# is ever deleted; the newest backup of each database is always kept.
+retention:
+  keep_last: 7        # the 7 most recent backups
+  keep_daily: 14      # the newest backup of each of the last 14 days
+  keep_weekly: 8      # ... of each of the last 8 ISO weeks
+  keep_monthly: 12    # ... of each of the last 12 months
+  # keep_hourly: 24
+  # max_age: 8760h    # delete anything older, whatever the rules above say
+  auto_prune: false   # prune after every successful backup
+
+# Optional client-side encryption of backups. Restore detects
+# encrypted backups and decrypts them automatically. Set exactly one key
+# source; a key is 32 bytes, e.g. from: openssl rand -hex 32 > backup.key
+# encryption:
+#   method: aes-256-gcm
+#   key_file: /etc/backup-tool/backup.key
+#   # key_env: BACKUP_KEY                  # hex/base64 key in an env var
+#   # passphrase_env: BACKUP_PASSPHRASE    # passphrase, stretched with scrypt
+#   # After rotating, keep old keys to restore older backups:
+#   # previous_keys:
+#   #   - key_file: /etc/backup-tool/old.key
+#
+# Or encrypt to public keys, so this host can't read its own backups;
+# restore with --identity <private key file>:
+# encryption:
+#   method: age                     # or pgp
+#   recipients: ["age1..."]         # age public keys
+#   # recipient_files: [./ops.asc]  # age recipients files / OpenPGP public keys
+
+# Settings for "backup-tool daemon", which backs up every database that has a
+# schedule.
+daemon:
+  jitter: 5m              # random delay before each scheduled run
+  catch_up: once          # run once at startup if a run was missed; or none
+  # shutdown_timeout: 1h  # how long SIGTERM waits for running backups
+
+# Databases that can be backed up, keyed by name (backup-tool backup <name>).
+databases:
+  {{quote .Name}}:
+    type: {{.Type}}
+{{- if eq .Type "sqlite"}}
+    path: {{quote .Path}}
+{{- else}}
+    host: {{quote .Host}}
+    port: {{.Port}}
+    user: {{quote .User}}
+    password: {{quote .Password}}
+{{- if eq .Type "redis"}}
+    data_directory: /var/lib/redis   # the server's dir, where BGSAVE writes dump.rdb
+{{- else}}
+    database: {{quote .Database}}
+{{- end}}
+{{- end}}
+    # schedule: "0 2 * * *"    # cron expression for backup-tool daemon
+    # tags: [production]        # select with backup-tool backup --tag production
+
+  # Examples for every supported database type:
+  #
+  # my_mysql_db:
+  #   type: mysql
+  #   host: localhost
+  #   port: 3306
+  #   user: root
+  #   password: password
+  #   database: my_app_db
+  #   # Dump options, shown with their defaults:
+  #   # single_transaction: true   # consistent InnoDB snapshot without locks
+  #   # routines: true
+  #   # triggers: true
+  #   # events: true
+  #   # hex_blob: true
+  #   # source_data: 2             # record binlog coordinates for restore --to-time, 0 to disable
+  #   # set_gtid_purged: AUTO
+  #   # extra_args: ["--column-statistics=0"]
+  #   # binlog:                    # archive binlogs for restore --to-time
+  #   #   enabled: true
+  #   #   upload_interval: 1m
+  #   #   server_id: 4242
+  #
+  # my_postgres_db:
+  #   type: postgres
+  #   host: localhost
+  #   port: 5432
+  #   user: postgres
+  #   password: password
+  #   database: analytics_db
+  #   format: custom       # plain (default), custom or directory
+  #   jobs: 4              # parallel pg_restore (and pg_dump for directory)
+  #   clean: true          # --clean --if-exists, so restores can be re-run
+  #   no_owner: true
+  #   no_privileges: true
+  #   globals: true        # also store roles and tablespaces (pg_dumpall --globals-only)
+  #   use_passfile: true   # pass the password in a temporary PGPASSFILE instead of PGPASSWORD
+  #
+  # my_postgres_cluster:
+  #   type: postgres
+  #   host: localhost
+  #   user: postgres
+  #   password: password
+  #   all_databases: true  # every database plus globals, with pg_dumpall
+  #
+  # my_postgres_physical:
+  #   type: postgres
+  #   host: localhost
+  #   user: replicator     # needs the REPLICATION attribute
+  #   password: password
+  #   format: basebackup   # physical backup of the cluster with pg_basebackup
+  #   data_directory: /var/lib/postgresql/16/main   # where restore unpacks it
+  #   # archive WAL for restore --to-time with, in postgresql.conf:
+  #   # archive_command = 'backup-tool --config /etc/backup-tool.yaml wal-push --db my_postgres_physical %p'
+  #
+  # my_mongo_db:
+  #   type: mongo
+  #   host: localhost
+  #   port: 27017
+  #   user: admin          # optional without access control
+  #   password: password
+  #   database: events
+  #   oplog: true          # consistent dump of the whole replica set (mongodump --oplog)
+  #   gzip: true           # mongodump --gzip
+  #   oplog_archive:       # archive oplog slices for restore --to-time
+  #     enabled: true
+  #     upload_interval: 1m
+  #
+  # my_redis_db:
+  #   type: redis
+  #   host: localhost
+  #   port: 6379
+  #   user: backup         # ACL user; omit to authenticate with requirepass
+  #   password: password
+  #   method: bgsave       # BGSAVE and copy the snapshot (default); or rdb: redis-cli --rdb, for remote servers
+  #   data_directory: /var/lib/redis   # the server's dir; restore stages the RDB here
+  #   # rdb_filename: dump.rdb
+  #   # tls: true
+  #   # tls_ca_cert: /etc/ssl/redis-ca.pem
+  #   # tls_cert: /etc/ssl/redis-client.pem   # client certificate, with tls_key
+  #   # tls_key: /etc/ssl/redis-client.key
+  #
+  # my_sqlite_db:
+  #   type: sqlite
+  #   path: ./data/app.db
+  #
+  # Any database can override the global retention policy:
+  #
+  # my_scratch_db:
+  #   type: sqlite
+  #   path: ./data/scratch.db
+  #   retention:
+  #     keep_last: 3
+  #     auto_prune: true
+`))
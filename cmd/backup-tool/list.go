@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"db-backup-tool/pkg/manifest"
+
+	"github.com/spf13/cobra"
+)
+
+var listRawFiles bool
+
+var listCmd = &cobra.Command{
+	Use:   "list [db_name]",
+	Short: "List backups",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		storageAdapter, err := getStorageAdapter(ctx)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if listRawFiles {
+			files, err := storageAdapter.ListFiles(ctx, listPrefix())
+			if err != nil {
+				fmt.Printf("Failed to list files: %v\n", err)
+				return
+			}
+			for _, f := range files {
+				fmt.Println(f)
+			}
+			return
+		}
+
+		manifests, err := manifest.List(ctx, storageAdapter, listPrefix())
+		if err != nil {
+			fmt.Printf("Failed to list backups: %v\n", err)
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tDATABASE\tTYPE\tSTARTED\tDURATION\tSIZE\tARTIFACT")
+		for _, m := range manifests {
+			if len(args) == 1 && m.Database != args[0] {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				m.ID, m.Database, m.DatabaseType,
+				m.StartTime.Local().Format("2006-01-02 15:04:05"),
+				m.EndTime.Sub(m.StartTime).Round(time.Second),
+				formatBytes(m.StoredSize),
+				m.Artifact,
+			)
+		}
+		tw.Flush()
+	},
+}
+
+func init() {
+	listCmd.Flags().BoolVar(&listRawFiles, "files", false, "list raw storage objects, including backups without a manifest")
+}
+
+// formatBytes renders n using binary units, e.g. 1.5 GiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
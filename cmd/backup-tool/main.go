@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"db-backup-tool/pkg/core"
 	"db-backup-tool/pkg/databases"
+	"db-backup-tool/pkg/encryption"
 	"db-backup-tool/pkg/storage"
 	"db-backup-tool/pkg/utils"
 
@@ -15,25 +19,52 @@ import (
 	"github.com/spf13/viper"
 )
 
-var cfgFile string
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var (
+	cfgFile   string
+	configErr error
+	timeout   time.Duration
+
+	// Private keys for decryption, see addIdentityFlags
+	identityFiles         []string
+	identityPassphraseEnv string
+)
 
 var rootCmd = &cobra.Command{
-	Use:   "backup-tool",
-	Short: "A CLI tool for database backups",
-	Long:  `A robust CLI utility to backup and restore various databases with support for local and cloud storage.`,
+	Use:     "backup-tool",
+	Short:   "A CLI tool for database backups",
+	Long:    `A robust CLI utility to backup and restore various databases with support for local and cloud storage.`,
+	Version: version,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if cmd.Annotations[stderrLogOnly] == "" {
+			utils.InitLogger()
+		}
+	},
 }
 
+// stderrLogOnly annotates commands that only log to stderr. PostgreSQL runs
+// wal-push and wal-fetch in its data directory, where backup_tool.log must
+// not be created; it captures their stderr in the server log instead.
+const stderrLogOnly = "stderr-log-only"
+
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// Ctrl-C and SIGTERM cancel the root context, which kills any running
+	// dump/restore process and aborts in-flight uploads.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
 func init() {
-	utils.InitLogger()
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./db_backup_config.yaml)")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "abort the operation after this duration (e.g. 30m, 0 for no limit)")
 
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(backupCmd)
@@ -52,187 +83,41 @@ func initConfig() {
 
 	viper.AutomaticEnv()
 
-	if err := viper.ReadInConfig(); err == nil {
-		// silently load config
-	}
-}
-
-var initCmd = &cobra.Command{
-	Use:   "init",
-	Short: "Initialize configuration",
-	Run: func(cmd *cobra.Command, args []string) {
-		// In a real app, this would write a default config file
-		fmt.Println("Configuration initialized.")
-	},
-}
-
-var backupCmd = &cobra.Command{
-	Use:   "backup [db_name]",
-	Short: "Backup a database",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		dbName := args[0]
-		utils.LogInfo(fmt.Sprintf("Starting backup for %s", dbName))
-
-		if !viper.IsSet(fmt.Sprintf("databases.%s", dbName)) {
-			utils.LogError(fmt.Sprintf("Database config '%s' not found", dbName))
-			return
-		}
-		dbConfig := viper.GetStringMap(fmt.Sprintf("databases.%s", dbName))
-
-		dbAdapter, err := getDatabaseAdapter(dbConfig["type"].(string))
-		if err != nil {
-			utils.LogError(err.Error())
-			return
-		}
-
-		storageAdapter, err := getStorageAdapter()
-		if err != nil {
-			utils.LogError(err.Error())
-			return
-		}
-
-		// Generate temp file name
-		ext := "sql"
-		if dbConfig["type"].(string) == "sqlite" {
-			ext = "db"
-		}
-		tempFile := fmt.Sprintf("temp_%s_%s.%s", dbName, time.Now().Format("20060102_150405"), ext)
-
-		slackWebhook := viper.GetString("notifications.slack_webhook")
-
-		// Perform Backup
-		backupPath, err := dbAdapter.Backup(dbConfig, tempFile)
-		if err != nil {
-			handleError(fmt.Sprintf("Backup failed for %s: %v", dbName, err), slackWebhook)
-			return
-		}
-		utils.LogInfo(fmt.Sprintf("Database backed up locally to: %s", backupPath))
-
-		// Compress
-		compressedPath, err := utils.CompressFile(backupPath)
-		if err != nil {
-			handleError(fmt.Sprintf("Compression failed: %v", err), slackWebhook)
-			os.Remove(backupPath)
-			return
-		}
-		os.Remove(backupPath)
-		backupPath = compressedPath
-		utils.LogInfo(fmt.Sprintf("Backup compressed to: %s", backupPath))
-
-		// Upload
-		storagePath := viper.GetString("storage.path")
-		remotePath := filepath.Join(storagePath, filepath.Base(backupPath))
-		uploadedPath, err := storageAdapter.Upload(backupPath, remotePath)
-		if err != nil {
-			handleError(fmt.Sprintf("Upload failed for %s: %v", dbName, err), slackWebhook)
-			os.Remove(backupPath)
-			return
-		}
-
-		successMsg := fmt.Sprintf("Backup successful for %s. Uploaded to: %s", dbName, uploadedPath)
-		utils.LogInfo(successMsg)
-		utils.SendSlackNotification(slackWebhook, successMsg)
-
-		os.Remove(backupPath)
-	},
+	// A missing or broken config file is only reported by the commands that
+	// need it, so that e.g. init works without one.
+	configErr = viper.ReadInConfig()
 }
 
-var restoreCmd = &cobra.Command{
-	Use:   "restore [backup_file] [db_name]",
-	Short: "Restore a database from a backup",
-	Args:  cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		backupFile := args[0]
-		dbName := args[1]
-		fmt.Printf("Restoring %s to %s...\n", backupFile, dbName)
-
-		if !viper.IsSet(fmt.Sprintf("databases.%s", dbName)) {
-			fmt.Printf("Database config '%s' not found\n", dbName)
-			return
-		}
-		dbConfig := viper.GetStringMap(fmt.Sprintf("databases.%s", dbName))
-
-		dbAdapter, err := getDatabaseAdapter(dbConfig["type"].(string))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		storageAdapter, err := getStorageAdapter()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		// Download
-		localBackupPath := filepath.Join(os.TempDir(), filepath.Base(backupFile))
-		downloadedPath, err := storageAdapter.Download(backupFile, localBackupPath)
-		if err != nil {
-			fmt.Printf("Download failed: %v\n", err)
-			return
-		}
-		fmt.Printf("Backup downloaded to: %s\n", downloadedPath)
-
-		// Decompress
-		restorePath := downloadedPath
-		if filepath.Ext(downloadedPath) == ".gz" {
-			fmt.Println("Decompressing backup...")
-			decompressedPath, err := utils.DecompressFile(downloadedPath)
-			if err != nil {
-				fmt.Printf("Decompression failed: %v\n", err)
-				return
-			}
-			restorePath = decompressedPath
-			fmt.Printf("Decompressed to: %s\n", restorePath)
-		}
-
-		// Restore
-		if err := dbAdapter.Restore(dbConfig, restorePath); err != nil {
-			fmt.Printf("Restore failed: %v\n", err)
-			return
-		}
-		fmt.Println("Database restored successfully!")
-
-		// Cleanup
-		if viper.GetString("storage.type") != "local" {
-			os.Remove(downloadedPath)
-			if restorePath != downloadedPath {
-				os.Remove(restorePath)
-			}
-		}
-	},
+func main() {
+	Execute()
 }
 
-var listCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List backups",
-	Run: func(cmd *cobra.Command, args []string) {
-		storageAdapter, err := getStorageAdapter()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// Helper functions
 
-		path := viper.GetString("storage.path")
-		files, err := storageAdapter.ListFiles(path)
-		if err != nil {
-			fmt.Printf("Failed to list files: %v\n", err)
-			return
-		}
+// loadDatabase looks up databases.<name> in the config file and returns its
+// settings together with the matching adapter, after validating them.
+func loadDatabase(name string) (core.Config, core.Database, error) {
+	key := fmt.Sprintf("databases.%s", name)
+	if !viper.IsSet(key) {
+		return nil, nil, fmt.Errorf("Database config '%s' not found", name)
+	}
+	dbConfig := core.Config(viper.GetStringMap(key))
 
-		for _, f := range files {
-			fmt.Println(f)
-		}
-	},
-}
+	dbType, _ := dbConfig["type"].(string)
+	if dbType == "" {
+		return nil, nil, &core.FieldError{Field: key + ".type", Msg: "is required"}
+	}
+	dbAdapter, err := getDatabaseAdapter(dbType)
+	if err != nil {
+		return nil, nil, &core.FieldError{Field: key + ".type", Msg: err.Error()}
+	}
 
-func main() {
-	Execute()
+	if err := dbAdapter.ValidateConfig(dbConfig); err != nil {
+		return nil, nil, core.PrefixFieldErrors(key, err)
+	}
+	return dbConfig, dbAdapter, nil
 }
 
-// Helper functions
-
 func getDatabaseAdapter(dbType string) (core.Database, error) {
 	switch dbType {
 	case "mysql":
@@ -243,12 +128,14 @@ func getDatabaseAdapter(dbType string) (core.Database, error) {
 		return &databases.PostgresDatabase{}, nil
 	case "mongo":
 		return &databases.MongoDatabase{}, nil
+	case "redis":
+		return &databases.RedisDatabase{}, nil
 	default:
 		return nil, fmt.Errorf("unsupported database type: %s", dbType)
 	}
 }
 
-func getStorageAdapter() (core.Storage, error) {
+func getStorageAdapter(ctx context.Context) (core.Storage, error) {
 	storageType := viper.GetString("storage.type")
 	switch storageType {
 	case "local":
@@ -256,16 +143,76 @@ func getStorageAdapter() (core.Storage, error) {
 	case "s3":
 		bucket := viper.GetString("storage.bucket")
 		region := viper.GetString("storage.region")
-		return storage.NewS3Storage(bucket, region)
+		endpoint := viper.GetString("storage.endpoint")
+		usePathStyle := viper.GetBool("storage.use_path_style")
+		return storage.NewS3Storage(ctx, bucket, region, endpoint, usePathStyle)
 	case "gcs":
 		bucket := viper.GetString("storage.bucket")
-		return storage.NewGCSStorage(bucket)
+		endpoint := viper.GetString("storage.endpoint")
+		return storage.NewGCSStorage(ctx, bucket, endpoint)
 	default:
 		return nil, fmt.Errorf("unsupported storage type: %s", storageType)
 	}
 }
 
-func handleError(msg string, webhook string) {
-	utils.LogError(msg)
-	utils.SendSlackNotification(webhook, msg)
+// encryptionConfig decodes the encryption section of the config file
+func encryptionConfig() (*encryption.Config, error) {
+	cfg, err := encryption.ParseConfig(core.Config(viper.GetStringMap("encryption")))
+	return cfg, core.PrefixFieldErrors("encryption", err)
+}
+
+// addIdentityFlags registers the flags that supply private keys for
+// decrypting age and OpenPGP backups.
+func addIdentityFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&identityFiles, "identity", nil, "age identity file or OpenPGP private key for decryption (repeatable)")
+	cmd.Flags().StringVar(&identityPassphraseEnv, "identity-passphrase-env", "", "environment variable holding the passphrase of a protected OpenPGP key")
+}
+
+// loadKeyring returns every configured key that may be needed to decrypt a
+// backup, together with the private keys given with --identity.
+func loadKeyring() (*encryption.Keyring, error) {
+	cfg, err := encryptionConfig()
+	if err != nil {
+		return nil, err
+	}
+	kr, err := cfg.Keyring()
+	if err != nil {
+		return nil, err
+	}
+
+	var passphrase []byte
+	if identityPassphraseEnv != "" {
+		passphrase = []byte(os.Getenv(identityPassphraseEnv))
+	}
+	for _, path := range identityFiles {
+		if err := kr.AddIdentityFile(path, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// commandContext returns the command's context, bounded by --timeout if set.
+func commandContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	ctx := cmd.Context()
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// remotePath joins elem onto storage.path using forward slashes, which all
+// storage backends accept.
+func remotePath(elem ...string) string {
+	return filepath.ToSlash(filepath.Join(append([]string{viper.GetString("storage.path")}, elem...)...))
+}
+
+// listPrefix returns the storage prefix under which all backups live.
+func listPrefix() string {
+	prefix := remotePath()
+	if prefix == "." && viper.GetString("storage.type") != "local" {
+		// Object stores list everything for an empty prefix, not for "."
+		return ""
+	}
+	return prefix
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/databases"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/manifest"
+	"db-backup-tool/pkg/utils"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// oplogArchiveConfig is the typed form of databases.<name>.oplog_archive
+type oplogArchiveConfig struct {
+	// Enabled archives the oplog while the daemon runs
+	Enabled bool `mapstructure:"enabled"`
+	// UploadInterval is how often a slice of the oplog is archived, which
+	// bounds how much is lost if the deployment goes away.
+	UploadInterval time.Duration `mapstructure:"upload_interval"`
+}
+
+func parseOplogArchiveConfig(dbName string) (*oplogArchiveConfig, error) {
+	key := fmt.Sprintf("databases.%s.oplog_archive", dbName)
+	cfg := &oplogArchiveConfig{UploadInterval: time.Minute}
+	if !viper.IsSet(key) {
+		return cfg, nil
+	}
+	if err := core.DecodeConfig(core.Config(viper.GetStringMap(key)), cfg); err != nil {
+		return nil, core.PrefixFieldErrors(key, err)
+	}
+
+	var errs []error
+	if t := viper.GetString(fmt.Sprintf("databases.%s.type", dbName)); t != "mongo" {
+		errs = append(errs, &core.FieldError{Field: key, Msg: "is only supported for mongo databases"})
+	}
+	if cfg.UploadInterval <= 0 {
+		errs = append(errs, &core.FieldError{Field: key + ".upload_interval", Msg: "must be positive"})
+	}
+	return cfg, errors.Join(errs...)
+}
+
+var oplogCmd = &cobra.Command{
+	Use:   "oplog [db_name]",
+	Short: "Continuously archive the MongoDB oplog",
+	Long: `Dump the oplog of a MongoDB replica set in slices and upload them to
+storage, compressed and encrypted like backups, for point-in-time recovery
+with "restore --to-time".
+
+A slice with the entries written since the previous one is archived every
+oplog_archive.upload_interval. Archiving resumes after the newest archived
+slice, or starts where the newest backup taken with "oplog: true" began.
+Runs until SIGTERM or Ctrl-C; the daemon does the same for databases with
+oplog_archive.enabled.`,
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbName := args[0]
+		cfg, err := parseOplogArchiveConfig(dbName)
+		if err != nil {
+			return err
+		}
+
+		// Not bounded by --timeout, this runs until it is stopped.
+		ctx := cmd.Context()
+		store, err := getStorageAdapter(ctx)
+		if err != nil {
+			return err
+		}
+		return archiveOplog(ctx, dbName, cfg, store)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(oplogCmd)
+}
+
+// oplogPrefix is where the oplog slices of a database are archived
+func oplogPrefix(dbName string) string {
+	return remotePath(dbName, "oplog")
+}
+
+// oplogSlice is an archived part of the oplog, holding the entries after
+// from up to and including to
+type oplogSlice struct {
+	from, to databases.MongoTimestamp
+	path     string
+}
+
+// oplogSliceName names a slice so that slices sort by position, e.g.
+// 1760000000-0000000001_1760000060-0000000003
+func oplogSliceName(from, to databases.MongoTimestamp) string {
+	return fmt.Sprintf("%010d-%010d_%010d-%010d", from.T, from.I, to.T, to.I)
+}
+
+// listOplogSlices returns the archived oplog slices of dbName in order
+func listOplogSlices(ctx context.Context, dbName string, store core.Storage) ([]oplogSlice, error) {
+	files, err := listArchived(ctx, store, oplogPrefix(dbName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list oplog slices: %v", err)
+	}
+	var slices []oplogSlice
+	for _, f := range files {
+		from, to, ok := strings.Cut(strings.TrimSuffix(f.name, ".bson"), "_")
+		if !ok {
+			continue
+		}
+		s := oplogSlice{path: f.path}
+		var errFrom, errTo error
+		s.from, errFrom = databases.ParseMongoTimestamp(strings.Replace(from, "-", ":", 1))
+		s.to, errTo = databases.ParseMongoTimestamp(strings.Replace(to, "-", ":", 1))
+		if errFrom == nil && errTo == nil {
+			slices = append(slices, s)
+		}
+	}
+	return slices, nil
+}
+
+// archiveOplog archives slices of the oplog of dbName until ctx is
+// cancelled.
+func archiveOplog(ctx context.Context, dbName string, cfg *oplogArchiveConfig, store core.Storage) error {
+	dbConfig, dbAdapter, err := loadDatabase(dbName)
+	if err != nil {
+		return err
+	}
+	mongo, ok := dbAdapter.(*databases.MongoDatabase)
+	if !ok {
+		return fmt.Errorf("oplog archiving is only supported for mongo databases, %s is %s", dbName, dbConfig["type"])
+	}
+
+	encCfg, err := encryptionConfig()
+	if err != nil {
+		return err
+	}
+	enc, err := encCfg.Encrypter()
+	if err != nil {
+		return fmt.Errorf("failed to load encryption key: %v", err)
+	}
+
+	a := &oplogArchiver{dbName: dbName, store: store, enc: enc, db: mongo, dbConfig: dbConfig}
+	if a.from, err = oplogStartPoint(ctx, a); err != nil {
+		return err
+	}
+	utils.LogInfo(fmt.Sprintf("Archiving the oplog of %s after %s", dbName, a.from))
+
+	ticker := time.NewTicker(cfg.UploadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.cut(ctx); err != nil {
+				utils.LogError(fmt.Sprintf("Failed to archive the oplog of %s: %v", dbName, err))
+			}
+		case <-ctx.Done():
+			// Archive what was written before stopping. If that fails, e.g.
+			// because Ctrl-C also stopped mongosh, it is archived when
+			// archiving resumes.
+			if err := a.cut(context.WithoutCancel(ctx)); err != nil {
+				utils.LogError(fmt.Sprintf("Failed to archive the oplog of %s: %v", dbName, err))
+			}
+			utils.LogInfo(fmt.Sprintf("Stopped archiving the oplog of %s", dbName))
+			return nil
+		}
+	}
+}
+
+// oplogStartPoint returns the position after which archiving starts: the
+// end of the newest archived slice, else the start of the newest backup
+// taken with the oplog, else the current end of the oplog.
+func oplogStartPoint(ctx context.Context, a *oplogArchiver) (databases.MongoTimestamp, error) {
+	slices, err := listOplogSlices(ctx, a.dbName, a.store)
+	if err != nil {
+		return databases.MongoTimestamp{}, err
+	}
+	if len(slices) > 0 {
+		return slices[len(slices)-1].to, nil
+	}
+
+	manifests, err := manifest.List(ctx, a.store, remotePath(a.dbName))
+	if err != nil {
+		return databases.MongoTimestamp{}, fmt.Errorf("failed to list backups: %v", err)
+	}
+	for i := len(manifests) - 1; i >= 0; i-- {
+		if s := manifests[i].Metadata["oplog_start"]; s != "" && manifests[i].Database == a.dbName {
+			return databases.ParseMongoTimestamp(s)
+		}
+	}
+
+	_, last, err := a.db.OplogRange(ctx, a.dbConfig)
+	return last, err
+}
+
+// oplogArchiver uploads the oplog of a database slice by slice
+type oplogArchiver struct {
+	dbName   string
+	store    core.Storage
+	enc      encryption.Encrypter
+	db       *databases.MongoDatabase
+	dbConfig core.Config
+	// from is the newest archived entry
+	from databases.MongoTimestamp
+}
+
+// cut archives the entries written since the last slice
+func (a *oplogArchiver) cut(ctx context.Context) error {
+	first, last, err := a.db.OplogRange(ctx, a.dbConfig)
+	if err != nil {
+		return err
+	}
+	if !a.from.Before(last) {
+		return nil
+	}
+	from := a.from
+	if from.Before(first) {
+		// The next slice doesn't continue the previous one, which restores
+		// detect as a gap.
+		utils.LogError(fmt.Sprintf("The oplog of %s was truncated after %s before it was archived; take a new backup", a.dbName, from))
+		from = databases.MongoTimestamp{T: first.T - 1}
+	}
+
+	dest := archivedPath(oplogPrefix(a.dbName), oplogSliceName(from, last)+".bson", a.enc)
+	produce := func(ctx context.Context, w io.Writer) error {
+		return a.db.DumpOplog(ctx, a.dbConfig, from, last, w)
+	}
+	if err := archiveStream(ctx, a.store, a.enc, produce, dest); err != nil {
+		return err
+	}
+	a.from = last
+	utils.LogInfo(fmt.Sprintf("Archived the oplog of %s up to %s", a.dbName, last))
+	return nil
+}
+
+// replayOplog replays the archived oplog slices from the position recorded
+// by m on up to stop.
+func replayOplog(ctx context.Context, store core.Storage, m *manifest.Manifest, stop time.Time, kr *encryption.Keyring, db *databases.MongoDatabase, dbConfig core.Config) error {
+	start, err := databases.ParseMongoTimestamp(m.Metadata["oplog_start"])
+	if err != nil {
+		return err
+	}
+	slices, err := listOplogSlices(ctx, m.Database, store)
+	if err != nil {
+		return err
+	}
+
+	limit := databases.MongoTimestamp{T: uint32(stop.Unix())}
+	var needed []oplogSlice
+	for _, s := range slices {
+		if start.Before(s.to) && s.from.Before(limit) {
+			needed = append(needed, s)
+		}
+	}
+	if len(needed) == 0 || start.Before(needed[0].from) {
+		return fmt.Errorf("the oplog after %s, where backup %s starts, has not been archived", start, m.ID)
+	}
+	for i := 1; i < len(needed); i++ {
+		if needed[i].from != needed[i-1].to {
+			return fmt.Errorf("the oplog between %s and %s is missing from the archive", needed[i-1].to, needed[i].from)
+		}
+	}
+	if end := needed[len(needed)-1].to; end.Before(limit) {
+		fmt.Printf("Note: the oplog is only archived up to %s\n", time.Unix(int64(end.T), 0).Local().Format(time.RFC3339))
+	}
+
+	// The slices are streamed one after another rather than opened at once.
+	pr, pw := io.Pipe()
+	go func() {
+		for _, s := range needed {
+			payload, err := openArchived(ctx, store, s.path, kr)
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("Download of oplog slice %s failed: %v", archivedName(s.path), err))
+				return
+			}
+			_, err = io.Copy(pw, payload)
+			payload.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	defer pr.Close()
+
+	fmt.Printf("Replaying %d oplog slice(s) from %s up to %s...\n", len(needed), start, stop.Local().Format(time.RFC3339))
+	if err := db.ReplayOplog(ctx, dbConfig, pr, stop); err != nil {
+		return fmt.Errorf("Point-in-time recovery failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/manifest"
+	"db-backup-tool/pkg/retention"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var pruneDryRun bool
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune [db_name]",
+	Short: "Delete backups that fall outside the retention policy",
+	Long: `Apply the retention policy to stored backups and delete the ones it doesn't
+keep. The global "retention" section applies to every database unless the
+database has a "retention" section of its own.
+
+Only backups with a manifest are considered. The newest backup of each
+database is never deleted.`,
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		storageAdapter, err := getStorageAdapter(ctx)
+		if err != nil {
+			return err
+		}
+
+		manifests, err := manifest.List(ctx, storageAdapter, listPrefix())
+		if err != nil {
+			return fmt.Errorf("failed to list backups: %v", err)
+		}
+
+		byDatabase := make(map[string][]*manifest.Manifest)
+		for _, m := range manifests {
+			if len(args) == 1 && m.Database != args[0] {
+				continue
+			}
+			byDatabase[m.Database] = append(byDatabase[m.Database], m)
+		}
+		names := make([]string, 0, len(byDatabase))
+		for name := range byDatabase {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		removed, failed := 0, 0
+		for _, name := range names {
+			policy, err := retentionPolicy(name)
+			if err != nil {
+				return err
+			}
+			if policy.IsZero() {
+				fmt.Printf("%s: no retention policy, keeping all %d backup(s)\n", name, len(byDatabase[name]))
+				continue
+			}
+
+			fmt.Printf("%s:\n", name)
+			n, err := pruneBackups(ctx, os.Stdout, storageAdapter, byDatabase[name], policy, pruneDryRun)
+			removed += n
+			if err != nil {
+				fmt.Printf("%s: %v\n", name, err)
+				failed++
+			}
+		}
+
+		if pruneDryRun {
+			fmt.Printf("Dry run: %d backup(s) would be removed\n", removed)
+		} else {
+			fmt.Printf("Removed %d backup(s)\n", removed)
+		}
+		if failed > 0 {
+			return fmt.Errorf("pruning failed for %d database(s)", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "show what would be removed without deleting anything")
+	rootCmd.AddCommand(pruneCmd)
+}
+
+// retentionPolicy returns the retention policy for a database: its own
+// retention section if it has one, the global one otherwise.
+func retentionPolicy(dbName string) (retention.Policy, error) {
+	key := fmt.Sprintf("databases.%s.retention", dbName)
+	if !viper.IsSet(key) {
+		key = "retention"
+	}
+	return parseRetention(key)
+}
+
+func parseRetention(key string) (retention.Policy, error) {
+	p, err := retention.ParsePolicy(core.Config(viper.GetStringMap(key)))
+	return p, core.PrefixFieldErrors(key, err)
+}
+
+// pruneBackups applies policy to the backups of one database, prints the
+// decisions to out and, unless dryRun is set, deletes the backups that
+// aren't kept. It returns the number of backups removed (or that would be).
+func pruneBackups(ctx context.Context, out io.Writer, store core.Storage, backups []*manifest.Manifest, policy retention.Policy, dryRun bool) (int, error) {
+	decisions := retention.Apply(backups, policy, time.Now())
+
+	removed := 0
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTARTED\tACTION\tREASON")
+	for _, d := range decisions {
+		action := "keep"
+		if !d.Keep {
+			action = "remove"
+			removed++
+		}
+		reason := strings.Join(d.Reasons, ", ")
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Manifest.ID, d.Manifest.StartTime.Local().Format("2006-01-02 15:04:05"), action, reason)
+	}
+	tw.Flush()
+
+	if dryRun {
+		return removed, nil
+	}
+
+	deleted := 0
+	for _, d := range decisions {
+		if d.Keep {
+			continue
+		}
+		if err := deleteBackup(ctx, store, d.Manifest); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteBackup removes an artifact and then its manifest, so that a backup
+// whose artifact couldn't be deleted is still listed and retried next time.
+func deleteBackup(ctx context.Context, store core.Storage, m *manifest.Manifest) error {
+	if err := store.Delete(ctx, m.Artifact); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", m.Artifact, err)
+	}
+	if m.Globals != nil {
+		if err := store.Delete(ctx, m.Globals.Artifact); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", m.Globals.Artifact, err)
+		}
+	}
+	if err := store.Delete(ctx, manifest.PathFor(m.Artifact)); err != nil {
+		return fmt.Errorf("failed to delete manifest of %s: %v", m.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/databases"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/manifest"
+	"db-backup-tool/pkg/storage"
+	"db-backup-tool/pkg/utils"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	restoreSkipVerify   bool
+	restoreLatest       bool
+	restoreAt           string
+	restoreToTime       string
+	restoreToLSN        string
+	restoreID           string
+	restoreTarget       string
+	restoreTargetDB     string
+	restoreCreateDB     bool
+	restoreDropExisting bool
+	restoreGlobals      bool
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore {backup_file db_name | db_name --latest | db_name --at TIME | db_name --id ID}",
+	Short: "Restore a database from a backup",
+	Long: `Restore a database from a backup. backup_file is the storage path of a
+backup artifact or of its manifest, as shown by "backup-tool list".
+
+Instead of a path, the backup can be picked from the database's manifests:
+--latest restores the newest backup of db_name, --at the newest one started
+at or before TIME, and --id the backup with that ID (see "backup-tool list").
+Backups taken before manifests were written can only be restored by path.
+
+--to-time recovers a MySQL database to a point in time: the newest backup
+that recorded its binlog position (see source_data) before TIME is restored,
+and the binlogs archived by "backup-tool binlog" are replayed on top of it up
+to TIME. For PostgreSQL, the newest base backup (format: basebackup) that
+finished before TIME is unpacked into data_directory and set up to replay
+the WAL archived by "backup-tool wal-push" up to TIME, or up to LSN with
+--to-lsn, when the server is started. For MongoDB, the newest dump taken with
+"oplog: true" that finished before TIME is restored and the oplog slices
+archived by "backup-tool oplog" are replayed up to TIME.
+
+The backup is restored into db_name, or into another configured database
+given with --target. --target-db restores under another database name (or,
+for SQLite, file path) on the same server. --create-db creates the target
+database if it doesn't exist, and --drop-existing drops and recreates it
+first. An existing SQLite file or Redis snapshot is only replaced with
+--drop-existing.
+
+--globals first replays the roles and tablespaces stored with backups of
+PostgreSQL databases that have "globals: true", e.g. on a fresh server.`,
+	Example: `  backup-tool restore prod --latest
+  backup-tool restore prod --at 2026-10-01T12:00:00Z
+  backup-tool restore prod --to-time "2026-10-01 12:34:56"
+  backup-tool restore pg --to-lsn 0/3000148 --drop-existing
+  backup-tool restore prod --latest --target staging --drop-existing
+  backup-tool restore prod --id prod-20261001T115500Z --target-db prod_20261001 --create-db`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if restoreSelector() == "" {
+			return cobra.ExactArgs(2)(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		dbName := args[len(args)-1]
+		targetName := dbName
+		if restoreTarget != "" {
+			targetName = restoreTarget
+		}
+
+		dbConfig, dbAdapter, err := loadDatabase(targetName)
+		if err != nil {
+			return err
+		}
+		if restoreTargetDB != "" {
+			if _, isRedis := dbAdapter.(*databases.RedisDatabase); isRedis {
+				return fmt.Errorf("--target-db is not supported for redis databases, which are restored as a whole; use --target")
+			}
+			dbConfig = retarget(dbConfig, restoreTargetDB)
+			if err := dbAdapter.ValidateConfig(dbConfig); err != nil {
+				return fmt.Errorf("Invalid --target-db: %v", err)
+			}
+		}
+
+		var toTime time.Time
+		if restoreToTime != "" {
+			if toTime, err = parseRestoreTime("--to-time", restoreToTime); err != nil {
+				return err
+			}
+		}
+		_, isMySQL := dbAdapter.(*databases.MySQLDatabase)
+		_, isPostgres := dbAdapter.(*databases.PostgresDatabase)
+		_, isMongo := dbAdapter.(*databases.MongoDatabase)
+		if restoreToTime != "" && !isMySQL && !isPostgres && !isMongo {
+			return fmt.Errorf("Point-in-time recovery is only supported for mysql, postgres and mongo databases, %s is %s", targetName, dbConfig["type"])
+		}
+		if restoreToLSN != "" && !isPostgres {
+			return fmt.Errorf("--to-lsn is only supported for postgres databases, %s is %s", targetName, dbConfig["type"])
+		}
+
+		storageAdapter, err := getStorageAdapter(ctx)
+		if err != nil {
+			return err
+		}
+
+		var artifact string
+		var m *manifest.Manifest
+		if len(args) == 2 {
+			artifact, m, err = resolveBackup(ctx, storageAdapter, args[0])
+		} else {
+			m, err = selectBackup(ctx, storageAdapter, dbName)
+			if m != nil {
+				artifact = m.Artifact
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restoring %s to %s...\n", artifact, describeTarget(targetName, dbConfig))
+
+		compressed := filepath.Ext(encryption.TrimExt(artifact)) == ".gz"
+		if m != nil {
+			if m.DatabaseType != dbConfig["type"] {
+				return fmt.Errorf("Backup %s is a %s backup and can't be restored into %s database %s", m.ID, m.DatabaseType, dbConfig["type"], targetName)
+			}
+			compressed = m.Compression == "gzip"
+		}
+
+		kr, err := loadKeyring()
+		if err != nil {
+			return fmt.Errorf("Failed to load decryption keys: %v", err)
+		}
+		if m != nil && !kr.CanDecrypt(m.Encryption) {
+			return fmt.Errorf("Backup %s is encrypted with %s but no decryption key is configured (see --identity)", m.ID, m.Encryption)
+		}
+
+		opts := core.RestoreOptions{
+			CreateDatabase: restoreCreateDB,
+			DropExisting:   restoreDropExisting,
+			SourceDatabase: sourceDatabase(m, dbName),
+		}
+		if m != nil {
+			opts.Metadata = m.Metadata
+			if opts.Metadata == nil {
+				opts.Metadata = map[string]string{}
+			}
+		}
+
+		base := m
+
+		if restoreGlobals {
+			if err := replayGlobals(ctx, storageAdapter, m, !restoreSkipVerify, kr, dbAdapter, dbConfig); err != nil {
+				return err
+			}
+		}
+
+		if restoreSkipVerify {
+			m = nil
+		}
+
+		streamDB, dbStreams := dbAdapter.(core.StreamingDatabase)
+		streamStorage, storageStreams := storageAdapter.(core.StreamingStorage)
+		if dbStreams && storageStreams {
+			err = streamRestore(ctx, streamStorage, artifact, m, compressed, kr, streamDB, dbConfig, opts)
+		} else {
+			err = fileRestore(ctx, storageAdapter, artifact, m, compressed, kr, dbAdapter, dbConfig, opts)
+		}
+		if err != nil {
+			return err
+		}
+
+		if pg, ok := dbAdapter.(*databases.PostgresDatabase); ok && (restoreToTime != "" || restoreToLSN != "") {
+			target := databases.PostgresRecoveryTarget{Time: toTime, LSN: restoreToLSN}
+			if err := writeRecoveryConfig(base.Database, pg, dbConfig, target); err != nil {
+				return err
+			}
+			stop := restoreToLSN
+			if stop == "" {
+				stop = toTime.Local().Format(time.RFC3339)
+			}
+			fmt.Printf("Base backup restored. Start the server to replay the archived WAL up to %s.\n", stop)
+			return nil
+		}
+		if restoreToTime != "" {
+			if mongo, ok := dbAdapter.(*databases.MongoDatabase); ok {
+				err = replayOplog(ctx, storageAdapter, base, toTime, kr, mongo, dbConfig)
+			} else {
+				err = replayBinlogs(ctx, storageAdapter, base, toTime, kr, dbAdapter.(*databases.MySQLDatabase), dbConfig, opts)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Println("Database restored successfully!")
+		return nil
+	},
+}
+
+func init() {
+	restoreCmd.Flags().BoolVar(&restoreSkipVerify, "skip-verify", false, "don't check the backup's checksum before restoring it")
+	restoreCmd.Flags().BoolVar(&restoreLatest, "latest", false, "restore the newest backup of db_name")
+	restoreCmd.Flags().StringVar(&restoreAt, "at", "", "restore the newest backup of db_name taken at or before this time (RFC 3339, or local \"2006-01-02 15:04:05\")")
+	restoreCmd.Flags().StringVar(&restoreID, "id", "", "restore the backup with this ID")
+	restoreCmd.Flags().StringVar(&restoreToTime, "to-time", "", "recover db_name to this point in time by replaying archived binlogs (MySQL), WAL (PostgreSQL) or oplog (MongoDB)")
+	restoreCmd.Flags().StringVar(&restoreToLSN, "to-lsn", "", "recover db_name up to this WAL location, e.g. 0/3000148 (PostgreSQL)")
+	restoreCmd.MarkFlagsMutuallyExclusive("latest", "at", "id", "to-time", "to-lsn")
+	restoreCmd.Flags().StringVar(&restoreTarget, "target", "", "restore into this configured database instead of db_name")
+	restoreCmd.Flags().StringVar(&restoreTargetDB, "target-db", "", "restore under this database name (SQLite: file path) instead of the configured one")
+	restoreCmd.Flags().BoolVar(&restoreCreateDB, "create-db", false, "create the target database if it doesn't exist")
+	restoreCmd.Flags().BoolVar(&restoreDropExisting, "drop-existing", false, "drop the target database and recreate it before restoring; needed to replace an existing SQLite file or Redis snapshot")
+	restoreCmd.Flags().BoolVar(&restoreGlobals, "globals", false, "restore the roles and tablespaces stored with the backup first")
+	addIdentityFlags(restoreCmd)
+}
+
+// retarget returns a copy of dbConfig that points at another database on
+// the same server, or another file for SQLite.
+func retarget(dbConfig core.Config, name string) core.Config {
+	c := make(core.Config, len(dbConfig))
+	for k, v := range dbConfig {
+		c[k] = v
+	}
+	if c["type"] == "sqlite" {
+		c["path"] = name
+	} else {
+		c["database"] = name
+	}
+	return c
+}
+
+// describeTarget names the restore target for progress output
+func describeTarget(name string, dbConfig core.Config) string {
+	if db, ok := dbConfig["database"].(string); ok && db != "" {
+		return fmt.Sprintf("%s (database %s)", name, db)
+	}
+	if path, ok := dbConfig["path"].(string); ok && path != "" {
+		return fmt.Sprintf("%s (%s)", name, path)
+	}
+	return name
+}
+
+// sourceDatabase returns the name of the database a backup was taken from,
+// as the engine knows it. Backups that don't record it fall back to the
+// configuration of the database they belong to.
+func sourceDatabase(m *manifest.Manifest, dbName string) string {
+	if m != nil {
+		if db := m.Metadata["database"]; db != "" {
+			return db
+		}
+		dbName = m.Database
+	}
+	return viper.GetString(fmt.Sprintf("databases.%s.database", dbName))
+}
+
+// restoreSelector returns the name of the flag used to pick a backup from
+// the manifests, or "" if the backup is given by path.
+func restoreSelector() string {
+	switch {
+	case restoreLatest:
+		return "latest"
+	case restoreAt != "":
+		return "at"
+	case restoreID != "":
+		return "id"
+	case restoreToTime != "":
+		return "to-time"
+	case restoreToLSN != "":
+		return "to-lsn"
+	default:
+		return ""
+	}
+}
+
+// selectBackup finds the backup picked by --latest, --at, --id, --to-time
+// or --to-lsn
+func selectBackup(ctx context.Context, store core.Storage, dbName string) (*manifest.Manifest, error) {
+	if restoreID != "" {
+		// IDs are unique across databases, so a backup of one database
+		// can be restored into another.
+		manifests, err := manifest.List(ctx, store, listPrefix())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups: %v", err)
+		}
+		for _, m := range manifests {
+			if m.ID == restoreID {
+				return m, nil
+			}
+		}
+		return nil, fmt.Errorf("no backup with ID %s", restoreID)
+	}
+
+	at := time.Now()
+	var err error
+	switch {
+	case restoreAt != "":
+		at, err = parseRestoreTime("--at", restoreAt)
+	case restoreToTime != "":
+		at, err = parseRestoreTime("--to-time", restoreToTime)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pitr := restoreToTime != "" || restoreToLSN != ""
+	var lsn uint64
+	if restoreToLSN != "" {
+		if lsn, err = databases.ParseLSN(restoreToLSN); err != nil {
+			return nil, err
+		}
+	}
+
+	manifests, err := manifest.List(ctx, store, remotePath(dbName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %v", err)
+	}
+	// Manifests are sorted oldest first.
+	var found *manifest.Manifest
+	for _, m := range manifests {
+		if m.Database != dbName || m.StartTime.After(at) {
+			continue
+		}
+		if pitr && !canRecoverFrom(m, at, lsn) {
+			continue
+		}
+		found = m
+	}
+	if found == nil {
+		switch dbType := viper.GetString(fmt.Sprintf("databases.%s.type", dbName)); {
+		case pitr && dbType == "postgres":
+			return nil, fmt.Errorf("no base backup of %s finished before the recovery target", dbName)
+		case pitr && dbType == "mongo":
+			return nil, fmt.Errorf("no backup of %s taken with \"oplog: true\" finished before %s", dbName, at.Local().Format(time.RFC3339))
+		}
+		if pitr {
+			return nil, fmt.Errorf("no backup of %s taken before %s records its binlog position", dbName, at.Local().Format(time.RFC3339))
+		}
+		if restoreAt != "" {
+			return nil, fmt.Errorf("no backup of %s was taken at or before %s", dbName, at.Local().Format(time.RFC3339))
+		}
+		return nil, fmt.Errorf("no backups of %s found", dbName)
+	}
+	return found, nil
+}
+
+// canRecoverFrom reports whether the --to-time or --to-lsn target can be
+// reached from backup m by replaying binlogs, WAL or the oplog
+func canRecoverFrom(m *manifest.Manifest, at time.Time, lsn uint64) bool {
+	switch m.DatabaseType {
+	case "mongo":
+		// The dump's own oplog is replayed in full, so it has to end
+		// before the target.
+		return m.Metadata["oplog_start"] != "" && !m.EndTime.After(at)
+	case "mysql":
+		// Binlogs can only be replayed from a known position.
+		return m.Metadata["binlog_file"] != ""
+	}
+	if m.Metadata["format"] != databases.PostgresFormatBaseBackup {
+		return false
+	}
+	// Recovery can't stop before the base backup is consistent.
+	if restoreToLSN != "" {
+		stop, err := databases.ParseLSN(m.Metadata["stop_lsn"])
+		return err == nil && stop <= lsn
+	}
+	return !m.EndTime.After(at)
+}
+
+// parseRestoreTime accepts RFC 3339 timestamps, and the local times printed
+// by "backup-tool list".
+func parseRestoreTime(flag, s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s time %q, expected e.g. 2026-10-01T12:00:00Z or \"2026-10-01 14:00:00\"", flag, s)
+}
+
+// resolveBackup accepts the path of an artifact or its manifest and returns
+// the artifact path and manifest. The manifest is nil for backups taken
+// before manifests were written.
+func resolveBackup(ctx context.Context, store core.Storage, ref string) (string, *manifest.Manifest, error) {
+	if strings.HasSuffix(ref, manifest.Suffix) {
+		m, err := manifest.Read(ctx, store, ref)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read manifest: %v", err)
+		}
+		return m.Artifact, m, nil
+	}
+
+	m, err := manifest.Read(ctx, store, manifest.PathFor(ref))
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.LogInfo(fmt.Sprintf("No manifest for %s, inferring format from file name", ref))
+		return ref, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return ref, m, nil
+}
+
+// replayGlobals restores the server-wide objects stored with m, verifying
+// them first unless verify is false.
+func replayGlobals(ctx context.Context, store core.Storage, m *manifest.Manifest, verify bool, kr *encryption.Keyring, db core.Database, dbConfig core.Config) error {
+	if m == nil || m.Globals == nil {
+		return fmt.Errorf("Backup has no globals, they are only stored for PostgreSQL databases with \"globals: true\"")
+	}
+	gdb, ok := db.(core.GlobalsDatabase)
+	if !ok {
+		return fmt.Errorf("Restoring globals is not supported for %s databases", dbConfig["type"])
+	}
+
+	pm := m.ForPart(m.Globals)
+	if verify {
+		fmt.Println("Verifying globals checksum...")
+		if err := manifest.Verify(ctx, store, pm, kr); err != nil {
+			return fmt.Errorf("Verification failed: %v", err)
+		}
+	}
+
+	rc, err := storage.Open(ctx, store, pm.Artifact)
+	if err != nil {
+		return fmt.Errorf("Download failed: %v", err)
+	}
+	defer rc.Close()
+
+	payload, err := openPayload(rc, pm.Compression == "gzip", kr)
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+
+	fmt.Println("Restoring globals...")
+	if err := gdb.RestoreGlobalsFrom(ctx, dbConfig, payload); err != nil {
+		return fmt.Errorf("Restoring globals failed: %v", err)
+	}
+	return nil
+}
+
+// streamRestore pipes the stored backup through decryption and decompression
+// straight into the database. If m is set, the backup is verified in a
+// separate pass first so that a corrupt backup is never fed to the database.
+func streamRestore(ctx context.Context, store core.StreamingStorage, artifact string, m *manifest.Manifest, compressed bool, kr *encryption.Keyring, db core.StreamingDatabase, dbConfig core.Config, opts core.RestoreOptions) error {
+	if m != nil {
+		fmt.Println("Verifying backup checksum...")
+		if err := manifest.Verify(ctx, store.(core.Storage), m, kr); err != nil {
+			return fmt.Errorf("Verification failed: %v", err)
+		}
+	}
+
+	rc, err := store.DownloadStream(ctx, artifact)
+	if err != nil {
+		return fmt.Errorf("Download failed: %v", err)
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if m != nil {
+		// Also catches the object changing between the two reads.
+		r = manifest.NewVerifyingReader(r, m)
+	}
+	payload, err := openPayload(r, compressed, kr)
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+
+	if err := db.RestoreFrom(ctx, dbConfig, payload, opts); err != nil {
+		return fmt.Errorf("Restore failed: %v", err)
+	}
+	return nil
+}
+
+// fileRestore downloads, decrypts and decompresses the backup into the temp
+// directory before restoring it.
+func fileRestore(ctx context.Context, store core.Storage, artifact string, m *manifest.Manifest, compressed bool, kr *encryption.Keyring, db core.Database, dbConfig core.Config, opts core.RestoreOptions) error {
+	// Download
+	localBackupPath := filepath.Join(os.TempDir(), filepath.Base(artifact))
+	downloadedPath, err := store.Download(ctx, artifact, localBackupPath)
+	if err != nil {
+		return fmt.Errorf("Download failed: %v", err)
+	}
+	defer os.Remove(downloadedPath)
+	fmt.Printf("Backup downloaded to: %s\n", downloadedPath)
+
+	if m != nil {
+		fmt.Println("Verifying backup checksum...")
+		if err := checkFile(downloadedPath, m, kr); err != nil {
+			return fmt.Errorf("Verification failed: %v", err)
+		}
+	}
+
+	// Decrypt and decompress
+	fmt.Println("Decompressing backup...")
+	restorePath, err := unpackFile(downloadedPath, compressed, kr)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(restorePath)
+	fmt.Printf("Decompressed to: %s\n", restorePath)
+
+	// Restore
+	if err := db.Restore(ctx, dbConfig, restorePath, opts); err != nil {
+		return fmt.Errorf("Restore failed: %v", err)
+	}
+	return nil
+}
+
+// openPayload undoes the encryption and compression of a stored backup.
+// Encrypted backups are recognised by their header, so backups without a
+// manifest are decrypted too.
+func openPayload(r io.Reader, compressed bool, kr *encryption.Keyring) (io.ReadCloser, error) {
+	dr, err := encryption.NewReader(r, kr)
+	if err != nil {
+		return nil, fmt.Errorf("Decryption failed: %v", err)
+	}
+	if !compressed {
+		return io.NopCloser(dr), nil
+	}
+
+	zr, err := utils.NewDecompressReader(dr)
+	if err != nil {
+		return nil, fmt.Errorf("Decompression failed: %v", err)
+	}
+	return zr, nil
+}
+
+// unpackFile writes the decrypted and decompressed contents of a downloaded
+// artifact to a new file next to it.
+func unpackFile(path string, compressed bool, kr *encryption.Keyring) (string, error) {
+	destPath := strings.TrimSuffix(encryption.TrimExt(path), ".gz")
+	if destPath == path {
+		destPath = path + ".raw"
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	payload, err := openPayload(src, compressed, kr)
+	if err != nil {
+		return "", err
+	}
+	defer payload.Close()
+
+	dst, err := os.Create(destPath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, payload); err != nil {
+		dst.Close()
+		os.Remove(destPath)
+		return "", fmt.Errorf("Decompression failed: %v", err)
+	}
+	return destPath, nil
+}
+
+// checkFile verifies a downloaded artifact against its manifest
+func checkFile(path string, m *manifest.Manifest, kr *encryption.Keyring) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return manifest.Check(f, m, kr)
+}
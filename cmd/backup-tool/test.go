@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var testAll bool
+
+var testCmd = &cobra.Command{
+	Use:           "test [db_name]",
+	Short:         "Test database connections and dump privileges",
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		var names []string
+		switch {
+		case testAll:
+			names = configuredDatabases()
+		case len(args) == 1:
+			names = args
+		default:
+			return fmt.Errorf("specify a database name or --all")
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DATABASE\tTYPE\tSTATUS\tVERSION\tCAN DUMP\tDETAIL")
+
+		failed := 0
+		for _, name := range names {
+			dbType, status, version, canDump, detail := testDatabase(ctx, name)
+			if status != "ok" {
+				failed++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, dbType, status, version, canDump, detail)
+		}
+		tw.Flush()
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d database(s) failed the connection test", failed, len(names))
+		}
+		return nil
+	},
+}
+
+func init() {
+	testCmd.Flags().BoolVar(&testAll, "all", false, "test every configured database")
+	rootCmd.AddCommand(testCmd)
+}
+
+// testDatabase runs TestConnection for one configured database and returns
+// the columns of its row in the status table.
+func testDatabase(ctx context.Context, name string) (dbType, status, version, canDump, detail string) {
+	dbType = viper.GetString(fmt.Sprintf("databases.%s.type", name))
+	dbConfig, dbAdapter, err := loadDatabase(name)
+	if err != nil {
+		return dbType, "error", "-", "-", strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	info, err := dbAdapter.TestConnection(ctx, dbConfig)
+	if err != nil {
+		return dbType, "error", "-", "-", err.Error()
+	}
+
+	canDump = "yes"
+	status = "ok"
+	if !info.CanDump {
+		canDump = "no"
+		status = "error"
+	}
+	return dbType, status, info.ServerVersion, canDump, info.Detail
+}
+
+// configuredDatabases returns the names of all databases in the config file,
+// sorted.
+func configuredDatabases() []string {
+	var names []string
+	for name := range viper.GetStringMap("databases") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/manifest"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyAll bool
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [backup]",
+	Short: "Check stored backups for corruption",
+	Long: `Download stored backups and check them against the size and SHA-256
+checksum recorded in their manifest. Encrypted backups must also decrypt
+with a configured key, and compressed backups decompress to the end.
+
+backup is the storage path of an artifact or its manifest. With --all,
+every backup that has a manifest is checked.`,
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if verifyAll == (len(args) == 1) {
+			return errors.New("specify a backup or --all")
+		}
+
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		storageAdapter, err := getStorageAdapter(ctx)
+		if err != nil {
+			return err
+		}
+		kr, err := loadKeyring()
+		if err != nil {
+			return fmt.Errorf("failed to load decryption keys: %v", err)
+		}
+
+		var manifests []*manifest.Manifest
+		if verifyAll {
+			manifests, err = manifest.List(ctx, storageAdapter, listPrefix())
+			if err != nil {
+				return fmt.Errorf("failed to list backups: %v", err)
+			}
+		} else {
+			artifact, m, err := resolveBackup(ctx, storageAdapter, args[0])
+			if err != nil {
+				return err
+			}
+			if m == nil {
+				// Without a manifest there is no checksum, but the gzip
+				// stream can still be checked.
+				m = &manifest.Manifest{ID: filepath.Base(artifact), Artifact: artifact}
+				if filepath.Ext(encryption.TrimExt(artifact)) == ".gz" {
+					m.Compression = "gzip"
+				}
+			}
+			manifests = append(manifests, m)
+		}
+
+		failed := 0
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tARTIFACT\tSTATUS\tDETAIL")
+		for _, m := range manifests {
+			status, detail := "ok", ""
+			switch {
+			case m.SHA256 == "":
+				detail = "no checksum recorded"
+			case !kr.CanDecrypt(m.Encryption):
+				detail = "checksum only, no decryption key"
+			}
+			err := manifest.Verify(ctx, storageAdapter, m, kr)
+			if err == nil && m.Globals != nil {
+				if err = manifest.Verify(ctx, storageAdapter, m.ForPart(m.Globals), kr); err != nil {
+					err = fmt.Errorf("globals: %v", err)
+				}
+			}
+			if err != nil {
+				status, detail = "FAILED", err.Error()
+				failed++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.ID, m.Artifact, status, detail)
+		}
+		tw.Flush()
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d backups failed verification", failed, len(manifests))
+		}
+		return nil
+	},
+}
+
+func init() {
+	verifyCmd.Flags().BoolVar(&verifyAll, "all", false, "verify every backup")
+	addIdentityFlags(verifyCmd)
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/databases"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/storage"
+	"db-backup-tool/pkg/utils"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// walDB is the database whose WAL is archived, see walDatabase
+var walDB string
+
+var walPushCmd = &cobra.Command{
+	Use:   "wal-push path",
+	Short: "Archive a PostgreSQL WAL file (archive_command)",
+	Long: `Compress, encrypt and upload a WAL file like a backup, for point-in-time
+recovery with "restore --to-time". Meant to be PostgreSQL's archive_command:
+
+  archive_mode = on
+  archive_command = 'backup-tool --config /etc/backup-tool.yaml wal-push --db main %p'
+
+Pushing a file that is already archived with the same contents succeeds, so
+PostgreSQL can retry after a failure; different contents are an error, as is
+an archived copy that can't be checked. A SHA-256 of each file is stored
+next to it for this check.`,
+	Annotations:   map[string]string{stderrLogOnly: "true"},
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		dbName, err := walDatabase()
+		if err != nil {
+			return err
+		}
+		store, err := getStorageAdapter(ctx)
+		if err != nil {
+			return err
+		}
+		encCfg, err := encryptionConfig()
+		if err != nil {
+			return err
+		}
+		enc, err := encCfg.Encrypter()
+		if err != nil {
+			return fmt.Errorf("failed to load encryption key: %v", err)
+		}
+		kr, err := loadKeyring()
+		if err != nil {
+			return fmt.Errorf("failed to load decryption keys: %v", err)
+		}
+		return pushWAL(ctx, store, enc, kr, dbName, args[0])
+	},
+}
+
+var walFetchCmd = &cobra.Command{
+	Use:   "wal-fetch name dest",
+	Short: "Restore an archived PostgreSQL WAL file (restore_command)",
+	Long: `Download the archived WAL file name to dest. Meant to be PostgreSQL's
+restore_command, which "restore --to-time" sets up:
+
+  restore_command = 'backup-tool --config /etc/backup-tool.yaml wal-fetch --db main %f %p'
+
+Fails if name has not been archived, which PostgreSQL expects at the end of
+the archive.`,
+	Annotations:   map[string]string{stderrLogOnly: "true"},
+	Args:          cobra.ExactArgs(2),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := commandContext(cmd)
+		defer cancel()
+
+		dbName, err := walDatabase()
+		if err != nil {
+			return err
+		}
+		store, err := getStorageAdapter(ctx)
+		if err != nil {
+			return err
+		}
+		kr, err := loadKeyring()
+		if err != nil {
+			return fmt.Errorf("failed to load decryption keys: %v", err)
+		}
+		return fetchWAL(ctx, store, kr, dbName, args[0], args[1])
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{walPushCmd, walFetchCmd} {
+		cmd.Flags().StringVar(&walDB, "db", "", "configured database the WAL belongs to (default: the only postgres database)")
+		addIdentityFlags(cmd)
+		rootCmd.AddCommand(cmd)
+	}
+}
+
+// walPrefix is where the WAL of a database is archived
+func walPrefix(dbName string) string {
+	return remotePath(dbName, "wal")
+}
+
+// walDatabase returns the database given with --db, or the only configured
+// postgres database.
+func walDatabase() (string, error) {
+	if walDB != "" {
+		if t := viper.GetString(fmt.Sprintf("databases.%s.type", walDB)); t != "postgres" {
+			return "", fmt.Errorf("WAL archiving is only supported for postgres databases, %s is %q", walDB, t)
+		}
+		return walDB, nil
+	}
+
+	var names []string
+	for name := range viper.GetStringMap("databases") {
+		if viper.GetString(fmt.Sprintf("databases.%s.type", name)) == "postgres" {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 1 {
+		sort.Strings(names)
+		return "", fmt.Errorf("--db is required, %d postgres databases are configured (%s)", len(names), strings.Join(names, ", "))
+	}
+	return names[0], nil
+}
+
+// walSumExt is appended to the path of an archived WAL file to store the
+// SHA-256 of its contents
+const walSumExt = ".sha256"
+
+// pushWAL archives the WAL file at local. The SHA-256 of its contents is
+// stored next to it, so that a retried push can be compared with the
+// archived copy without decrypting it, which hosts that only have age or
+// OpenPGP recipients can't.
+func pushWAL(ctx context.Context, store core.Storage, enc encryption.Encrypter, kr *encryption.Keyring, dbName, local string) error {
+	name := filepath.Base(local)
+	dest := archivedPath(walPrefix(dbName), name, enc)
+
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	sum, err := sha256Of(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	same, err := archivedCopyMatches(ctx, store, kr, dest, sum)
+	switch {
+	case err != nil:
+		return err
+	case same:
+		utils.LogInfo(fmt.Sprintf("WAL file %s of %s is already archived", name, dbName))
+		return nil
+	}
+
+	// The checksum goes first: a push that fails after it finds no WAL file
+	// when retried, and stores both again.
+	if _, err := storage.Put(ctx, store, strings.NewReader(hex.EncodeToString(sum)+"\n"), dest+walSumExt); err != nil {
+		return fmt.Errorf("failed to archive checksum of WAL file %s: %v", name, err)
+	}
+	if _, err := archiveFile(ctx, store, enc, local, walPrefix(dbName)); err != nil {
+		return fmt.Errorf("failed to archive WAL file %s: %v", name, err)
+	}
+	utils.LogInfo(fmt.Sprintf("Archived WAL file %s of %s", name, dbName))
+	return nil
+}
+
+// archivedCopyMatches reports whether remote holds contents with the given
+// SHA-256; false means there is no archived copy. It returns an error if
+// remote holds other contents, or if that can't be checked, so that the
+// push fails and PostgreSQL retries it rather than anything being replaced.
+func archivedCopyMatches(ctx context.Context, store core.Storage, kr *encryption.Keyring, remote string, sum []byte) (bool, error) {
+	name := archivedName(remote)
+	exists, err := archivedExists(ctx, store, remote)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for an archived copy of %s: %v", name, err)
+	}
+	if !exists {
+		return false, nil
+	}
+
+	archivedSum, err := readWALSum(ctx, store, remote+walSumExt)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Archived without a checksum, so the copy itself is compared.
+		var archived io.ReadCloser
+		if archived, err = openArchived(ctx, store, remote, kr); err == nil {
+			archivedSum, err = sha256Of(archived)
+			archived.Close()
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to compare %s with its archived copy: %v", name, err)
+	}
+
+	if !bytes.Equal(archivedSum, sum) {
+		return false, fmt.Errorf("%s is already archived with different contents", name)
+	}
+	return true, nil
+}
+
+// readWALSum reads a checksum stored by pushWAL
+func readWALSum(ctx context.Context, store core.Storage, remote string) ([]byte, error) {
+	rc, err := storage.Open(ctx, store, remote)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 1024))
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+func sha256Of(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// fetchWAL restores the archived WAL file name to dest. The file is written
+// next to dest and renamed, so the server never sees a partial file.
+func fetchWAL(ctx context.Context, store core.Storage, kr *encryption.Keyring, dbName, name, dest string) error {
+	// Files archived before the encryption settings changed have another
+	// extension, so every one is tried.
+	for _, ext := range append([]string{""}, encryption.Exts...) {
+		remote := path.Join(walPrefix(dbName), name+".gz") + ext
+		rc, err := storage.Open(ctx, store, remote)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			// Reporting the file as missing would end recovery early.
+			return fmt.Errorf("failed to read WAL file %s: %v", name, err)
+		}
+		defer rc.Close()
+
+		payload, err := openPayload(rc, true, kr)
+		if err != nil {
+			return fmt.Errorf("failed to read WAL file %s: %v", name, err)
+		}
+		defer payload.Close()
+
+		tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, payload)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore WAL file %s: %v", name, err)
+		}
+		return os.Rename(tmp.Name(), dest)
+	}
+	return fmt.Errorf("WAL file %s of %s is not archived", name, dbName)
+}
+
+// walRestoreCommand returns the restore_command that fetches the WAL of
+// dbName with this binary, config file and identities.
+func walRestoreCommand(dbName string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	args := []string{exe}
+	if f := viper.ConfigFileUsed(); f != "" {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--config", abs)
+	}
+	for _, f := range identityFiles {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--identity", abs)
+	}
+	if identityPassphraseEnv != "" {
+		args = append(args, "--identity-passphrase-env", identityPassphraseEnv)
+	}
+	args = append(args, "wal-fetch", "--db", dbName)
+
+	// The server substitutes %f and %p, and turns %% into %.
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = strings.ReplaceAll(shellQuote(a), "%", "%%")
+	}
+	return strings.Join(quoted, " ") + " %f %p", nil
+}
+
+// shellQuote quotes s for /bin/sh, unless it is safe as is
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./:=@+,") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeRecoveryConfig makes the base backup restored into dbConfig's data
+// directory replay the WAL archived for dbName up to target once the server
+// is started.
+func writeRecoveryConfig(dbName string, db *databases.PostgresDatabase, dbConfig core.Config, target databases.PostgresRecoveryTarget) error {
+	restoreCommand, err := walRestoreCommand(dbName)
+	if err != nil {
+		return err
+	}
+	if err := db.WriteRecoveryConfig(dbConfig, restoreCommand, target); err != nil {
+		return fmt.Errorf("Failed to write recovery settings: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// FieldError reports a missing or invalid configuration field
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Msg)
+}
+
+// DecodeConfig decodes raw into out, which must be a pointer to a struct with
+// mapstructure tags. Fields already set on out act as defaults. Numbers and
+// booleans given as strings (e.g. port: "5432") are converted. Decoding
+// problems are returned as *FieldError values joined with errors.Join.
+func DecodeConfig(raw Config, out interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           out,
+		WeaklyTypedInput: true,
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := decoder.Decode(map[string]interface{}(raw)); err != nil {
+		var fieldErrs []error
+		for _, e := range flattenErrors(err) {
+			var de *mapstructure.DecodeError
+			if errors.As(e, &de) {
+				fieldErrs = append(fieldErrs, &FieldError{Field: de.Name(), Msg: de.Unwrap().Error()})
+			} else {
+				fieldErrs = append(fieldErrs, e)
+			}
+		}
+		return errors.Join(fieldErrs...)
+	}
+	return nil
+}
+
+// PrefixFieldErrors qualifies the field names in err with prefix, e.g.
+// "port" becomes "databases.prod.port".
+func PrefixFieldErrors(prefix string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var out []error
+	for _, e := range flattenErrors(err) {
+		var fe *FieldError
+		if errors.As(e, &fe) {
+			out = append(out, &FieldError{Field: prefix + "." + fe.Field, Msg: fe.Msg})
+		} else {
+			out = append(out, fmt.Errorf("%s: %v", prefix, e))
+		}
+	}
+	return errors.Join(out...)
+}
+
+// flattenErrors expands errors created with errors.Join into a flat list.
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+
+	var out []error
+	for _, e := range joined.Unwrap() {
+		out = append(out, flattenErrors(e)...)
+	}
+	return out
+}
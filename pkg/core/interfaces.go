@@ -1,18 +1,96 @@
 package core
 
+import (
+	"context"
+	"io"
+)
+
 // Config holds the configuration for a backup operation
 type Config map[string]interface{}
 
-// Database interface for backup and restore operations
+// Database interface for backup and restore operations.
+// Implementations must stop any running dump/restore process and clean up
+// partial output when ctx is cancelled.
 type Database interface {
-	Backup(config Config, outputPath string) (string, error)
-	Restore(config Config, backupPath string) error
-	TestConnection(config Config) error
+	Backup(ctx context.Context, config Config, outputPath string) (string, error)
+	Restore(ctx context.Context, config Config, backupPath string, opts RestoreOptions) error
+	TestConnection(ctx context.Context, config Config) (ConnectionInfo, error)
+	// ValidateConfig checks config without connecting to the database
+	ValidateConfig(config Config) error
+}
+
+// RestoreOptions control how a backup is restored into the configured
+// database. The zero value restores into the existing database as is.
+type RestoreOptions struct {
+	// CreateDatabase creates the target database if it doesn't exist
+	CreateDatabase bool
+	// DropExisting drops the target database before restoring, and then
+	// creates it again. MongoDB drops the restored collections instead.
+	DropExisting bool
+	// SourceDatabase is the name of the database the backup was taken
+	// from. MongoDB archives keep it in their namespaces, so restoring into
+	// a database of another name needs it.
+	SourceDatabase string
+	// Metadata holds the engine-specific details recorded in the backup's
+	// manifest. It is nil for backups without a manifest, in which case
+	// adapters fall back to their config.
+	Metadata map[string]string
+}
+
+// ConnectionInfo describes a database server as seen by TestConnection
+type ConnectionInfo struct {
+	ServerVersion string
+	// CanDump reports whether the configured user has the privileges the
+	// dump tool needs; Detail explains why not.
+	CanDump bool
+	Detail  string
 }
 
 // Storage interface for uploading and downloading backups
 type Storage interface {
-	Upload(localPath, remotePath string) (string, error)
-	Download(remotePath, localPath string) (string, error)
-	ListFiles(prefix string) ([]string, error)
+	Upload(ctx context.Context, localPath, remotePath string) (string, error)
+	Download(ctx context.Context, remotePath, localPath string) (string, error)
+	ListFiles(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the object at path. Deleting a missing object is not
+	// an error.
+	Delete(ctx context.Context, path string) error
+}
+
+// StreamingDatabase is implemented by adapters that can write a dump to, and
+// restore it from, a stream. This lets the backup pipeline run without any
+// intermediate files on local disk.
+type StreamingDatabase interface {
+	BackupTo(ctx context.Context, config Config, w io.Writer) (BackupInfo, error)
+	RestoreFrom(ctx context.Context, config Config, r io.Reader, opts RestoreOptions) error
+}
+
+// DumpExtDatabase is implemented by adapters whose dump format, and so the
+// artifact's file extension, depends on the config.
+type DumpExtDatabase interface {
+	// DumpExt returns the extension without compression, e.g. "sql"
+	DumpExt(config Config) string
+}
+
+// GlobalsDatabase is implemented by adapters that can back up server-wide
+// objects, such as PostgreSQL roles and tablespaces, next to a database.
+type GlobalsDatabase interface {
+	// WantsGlobals reports whether config asks for globals to be backed up
+	WantsGlobals(config Config) bool
+	BackupGlobalsTo(ctx context.Context, config Config, w io.Writer) error
+	RestoreGlobalsFrom(ctx context.Context, config Config, r io.Reader) error
+}
+
+// BackupInfo describes a finished dump; it is recorded in the backup manifest
+type BackupInfo struct {
+	ServerVersion   string
+	DumpToolVersion string
+	// Metadata holds engine-specific details, e.g. binlog coordinates.
+	Metadata map[string]string
+}
+
+// StreamingStorage is implemented by backends that can upload from and
+// download to a stream of unknown length.
+type StreamingStorage interface {
+	UploadStream(ctx context.Context, r io.Reader, remotePath string) (string, error)
+	DownloadStream(ctx context.Context, remotePath string) (io.ReadCloser, error)
 }
@@ -0,0 +1,42 @@
+package databases
+
+import (
+	"db-backup-tool/pkg/core"
+	"errors"
+)
+
+// ServerConfig holds the connection settings shared by the client/server
+// engines. Engine configs embed it with `mapstructure:",squash"`.
+type ServerConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	Database string `mapstructure:"database"`
+}
+
+func (c *ServerConfig) validate(requireUser bool) []error {
+	var errs []error
+	if c.Host == "" {
+		errs = append(errs, &core.FieldError{Field: "host", Msg: "is required"})
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, &core.FieldError{Field: "port", Msg: "must be between 1 and 65535"})
+	}
+	if requireUser && c.User == "" {
+		errs = append(errs, &core.FieldError{Field: "user", Msg: "is required"})
+	}
+	if c.Database == "" {
+		errs = append(errs, &core.FieldError{Field: "database", Msg: "is required"})
+	}
+	return errs
+}
+
+// decodeConfig decodes raw into cfg (pre-filled with defaults) and runs the
+// given validation.
+func decodeConfig(raw core.Config, cfg interface{}, validate func() []error) error {
+	if err := core.DecodeConfig(raw, cfg); err != nil {
+		return err
+	}
+	return errors.Join(validate()...)
+}
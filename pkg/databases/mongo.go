@@ -1,51 +1,211 @@
 package databases
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"db-backup-tool/pkg/core"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 )
 
 type MongoDatabase struct{}
 
-func (db *MongoDatabase) Backup(config core.Config, outputPath string) (string, error) {
-	// mongodump --uri="mongodb://[user]:[password]@[host]:[port]/[database]" --archive=[outputPath]
+// MongoConfig is the typed form of a `type: mongo` database entry
+type MongoConfig struct {
+	ServerConfig `mapstructure:",squash"`
+	// Oplog dumps the whole deployment with --oplog, so that the dump is a
+	// consistent snapshot of a busy replica set, and replays the captured
+	// oplog on restore. database is then only used to authenticate.
+	Oplog bool `mapstructure:"oplog"`
+	// Gzip has mongodump compress the archive itself (--gzip)
+	Gzip bool `mapstructure:"gzip"`
+}
+
+func parseMongoConfig(raw core.Config) (*MongoConfig, error) {
+	cfg := &MongoConfig{ServerConfig: ServerConfig{Host: "localhost", Port: 27017}}
+	if err := decodeConfig(raw, cfg, cfg.validate); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// uri builds the connection string, escaping credentials so that passwords
+// containing '@', ':' or '/' work.
+func (c *MongoConfig) uri() string {
+	u := url.URL{
+		Scheme: "mongodb",
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:   "/" + c.Database,
+	}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+	}
+	return u.String()
+}
+
+// clusterURI connects to the deployment rather than to the database, which
+// remains the authentication database.
+func (c *MongoConfig) clusterURI() string {
+	u := url.URL{
+		Scheme: "mongodb",
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:   "/",
+	}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+		u.RawQuery = url.Values{"authSource": {c.Database}}.Encode()
+	}
+	return u.String()
+}
+
+// command returns a mongodump or mongorestore command for the database
+// that reads the connection string, which holds the password, from a
+// temporary --config file rather than the command line. Call cleanup once
+// it has exited.
+func (c *MongoConfig) command(ctx context.Context, name string, args ...string) (*exec.Cmd, func(), error) {
+	return mongoCommand(ctx, c.uri(), name, args...)
+}
+
+// clusterCommand is like command, but for the whole deployment
+func (c *MongoConfig) clusterCommand(ctx context.Context, name string, args ...string) (*exec.Cmd, func(), error) {
+	return mongoCommand(ctx, c.clusterURI(), name, args...)
+}
+
+func mongoCommand(ctx context.Context, connString, name string, args ...string) (*exec.Cmd, func(), error) {
+	// A JSON string is a valid YAML scalar.
+	uri, _ := json.Marshal(connString)
+	path, cleanup, err := secretFile("mongo-*.yaml", []byte(fmt.Sprintf("uri: %s\n", uri)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write mongo config file: %v", err)
+	}
+	cmd := exec.CommandContext(ctx, name, append([]string{"--config=" + path}, args...)...)
+	return cmd, cleanup, nil
+}
+
+func (c *MongoConfig) validate() []error {
+	// Mongo deployments without access control need no credentials
+	return c.ServerConfig.validate(false)
+}
+
+func (db *MongoDatabase) ValidateConfig(config core.Config) error {
+	_, err := parseMongoConfig(config)
+	return err
+}
+
+func (db *MongoDatabase) Backup(ctx context.Context, config core.Config, outputPath string) (string, error) {
+	return backupToFile(ctx, db, config, outputPath)
+}
+
+func (db *MongoDatabase) BackupTo(ctx context.Context, config core.Config, w io.Writer) (core.BackupInfo, error) {
+	// mongodump --config=[file with uri] --archive [--oplog] [--gzip] > [w]
+
+	var info core.BackupInfo
+
+	cfg, err := parseMongoConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	// Versions are best-effort and only recorded in the manifest
+	info.DumpToolVersion = commandVersion(ctx, "mongodump")
+	info.ServerVersion, _ = mongoEval(ctx, cfg, "print(db.version())")
+	// The archive's namespaces start with the database name, which a
+	// restore under another name has to rewrite.
+	info.Metadata = map[string]string{"database": cfg.Database}
 
-	user := config["user"].(string)
-	password := config["password"].(string)
-	host := config["host"].(string)
-	port := config["port"].(int)
-	database := config["database"].(string)
+	// --archive without a value writes the archive to stdout
+	args := []string{"--archive"}
+	if cfg.Gzip {
+		args = append(args, "--gzip")
+	}
+	command := cfg.command
+	if cfg.Oplog {
+		// --oplog is only supported for dumps of the whole deployment.
+		command = cfg.clusterCommand
+		args = append(args, "--oplog")
+		delete(info.Metadata, "database")
+		info.Metadata["oplog"] = "true"
 
-	uri := fmt.Sprintf("mongodb://%s:%s@%s:%d/%s", user, password, host, port, database)
+		// Oplog slices from here on can be replayed on top of the dump.
+		_, last, err := db.OplogRange(ctx, config)
+		if err != nil {
+			return info, err
+		}
+		info.Metadata["oplog_start"] = last.String()
+	}
 
-	cmd := exec.Command("mongodump",
-		fmt.Sprintf("--uri=%s", uri),
-		fmt.Sprintf("--archive=%s", outputPath),
-	)
+	cmd, cleanup, err := command(ctx, "mongodump", args...)
+	if err != nil {
+		return info, err
+	}
+	defer cleanup()
+	cmd.Stdout = w
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("mongodump failed: %v", err)
+		return info, fmt.Errorf("mongodump failed: %v", err)
 	}
 
-	return outputPath, nil
+	return info, nil
 }
 
-func (db *MongoDatabase) Restore(config core.Config, backupPath string) error {
-	// mongorestore --uri="mongodb://[user]:[password]@[host]:[port]/[database]" --archive=[backupPath]
+func (db *MongoDatabase) Restore(ctx context.Context, config core.Config, backupPath string, opts core.RestoreOptions) error {
+	return restoreFromFile(ctx, db, config, backupPath, opts)
+}
 
-	user := config["user"].(string)
-	password := config["password"].(string)
-	host := config["host"].(string)
-	port := config["port"].(int)
-	database := config["database"].(string)
+func (db *MongoDatabase) RestoreFrom(ctx context.Context, config core.Config, r io.Reader, opts core.RestoreOptions) error {
+	// mongorestore --config=[file with uri] --archive [--oplogReplay] [--gzip] < [r]
 
-	uri := fmt.Sprintf("mongodb://%s:%s@%s:%d/%s", user, password, host, port, database)
+	cfg, err := parseMongoConfig(config)
+	if err != nil {
+		return err
+	}
 
-	cmd := exec.Command("mongorestore",
-		fmt.Sprintf("--uri=%s", uri),
-		fmt.Sprintf("--archive=%s", backupPath),
-	)
+	args := []string{"--archive"}
+	// Archives written with --gzip are recognised by their header.
+	br := bufio.NewReader(r)
+	if prefix, _ := br.Peek(2); bytes.Equal(prefix, []byte{0x1f, 0x8b}) {
+		args = append(args, "--gzip")
+	}
+
+	oplog := cfg.Oplog
+	if opts.Metadata != nil {
+		oplog = opts.Metadata["oplog"] == "true"
+	}
+	if oplog {
+		if opts.SourceDatabase != "" && opts.SourceDatabase != cfg.Database {
+			return fmt.Errorf("oplog dumps hold the whole deployment and can't be restored into another database")
+		}
+		args = append(args, "--oplogReplay")
+	} else if opts.SourceDatabase != "" && opts.SourceDatabase != cfg.Database {
+		args = append(args,
+			fmt.Sprintf("--nsFrom=%s.*", opts.SourceDatabase),
+			fmt.Sprintf("--nsTo=%s.*", cfg.Database),
+		)
+	}
+	// MongoDB creates databases on first write, so CreateDatabase needs no
+	// extra step.
+	if opts.DropExisting {
+		args = append(args, "--drop")
+	}
+
+	command := cfg.command
+	if oplog {
+		command = cfg.clusterCommand
+	}
+	cmd, cleanup, err := command(ctx, "mongorestore", args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdin = br
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("mongorestore failed: %v", err)
@@ -54,6 +214,68 @@ func (db *MongoDatabase) Restore(config core.Config, backupPath string) error {
 	return nil
 }
 
-func (db *MongoDatabase) TestConnection(config core.Config) error {
-	return nil // Dummy implementation
+// mongoTestScript pings the server and checks whether the authenticated user
+// may run "find" on the target database, which mongodump requires.
+const mongoTestScript = `
+db.runCommand({ping: 1});
+const status = db.runCommand({connectionStatus: 1, showPrivileges: true});
+const auth = status.authInfo;
+const canDump = auth.authenticatedUsers.length === 0 ||
+	(auth.authenticatedUserPrivileges || []).some(p =>
+		p.actions.includes("find") &&
+		(p.resource.anyResource || p.resource.db === "" || p.resource.db === db.getName()));
+print(JSON.stringify({version: db.version(), canDump: canDump}));
+`
+
+func (db *MongoDatabase) TestConnection(ctx context.Context, config core.Config) (core.ConnectionInfo, error) {
+	// mongosh --nodb --quiet --eval [connect; script]
+
+	var info core.ConnectionInfo
+
+	cfg, err := parseMongoConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	out, err := mongoEval(ctx, cfg, mongoTestScript)
+	if err != nil {
+		return info, err
+	}
+
+	var result struct {
+		Version string `json:"version"`
+		CanDump bool   `json:"canDump"`
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return info, fmt.Errorf("unexpected mongosh output: %s", out)
+	}
+
+	info.ServerVersion = result.Version
+	info.CanDump = result.CanDump
+	if !info.CanDump {
+		info.Detail = fmt.Sprintf("user lacks find on %s", cfg.Database)
+	}
+
+	return info, nil
+}
+
+// mongoURIEnv passes the connection string to mongosh, which has no
+// --config option.
+const mongoURIEnv = "BACKUP_TOOL_MONGO_URI"
+
+// mongoEval runs a script with mongosh and returns its trimmed output. The
+// script connects itself, so the password is passed in the environment
+// rather than on the command line.
+func mongoEval(ctx context.Context, cfg *MongoConfig, script string) (string, error) {
+	script = fmt.Sprintf("db = connect(process.env.%s);\n%s", mongoURIEnv, script)
+	cmd := exec.CommandContext(ctx, "mongosh", "--nodb", "--quiet", "--eval", script)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", mongoURIEnv, cfg.uri()))
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("mongosh failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
 }
@@ -0,0 +1,154 @@
+package databases
+
+import (
+	"context"
+	"db-backup-tool/pkg/core"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MongoTimestamp is a BSON timestamp, which orders oplog entries: seconds
+// since the epoch and a counter within the second
+type MongoTimestamp struct {
+	T, I uint32
+}
+
+// String formats ts like mongorestore's --oplogLimit, e.g. 1760000000:5
+func (ts MongoTimestamp) String() string {
+	return fmt.Sprintf("%d:%d", ts.T, ts.I)
+}
+
+// Before reports whether ts comes before o
+func (ts MongoTimestamp) Before(o MongoTimestamp) bool {
+	return ts.T < o.T || ts.T == o.T && ts.I < o.I
+}
+
+// ParseMongoTimestamp parses a timestamp formatted by String
+func ParseMongoTimestamp(s string) (MongoTimestamp, error) {
+	t, i, ok := strings.Cut(s, ":")
+	if ok {
+		tv, errT := strconv.ParseUint(t, 10, 32)
+		iv, errI := strconv.ParseUint(i, 10, 32)
+		if errT == nil && errI == nil {
+			return MongoTimestamp{T: uint32(tv), I: uint32(iv)}, nil
+		}
+	}
+	return MongoTimestamp{}, fmt.Errorf("invalid timestamp %q, expected e.g. 1760000000:5", s)
+}
+
+// mongoOplogRangeScript prints the timestamps of the oldest and newest
+// oplog entries. Timestamp exposes its parts as the bits of a Long in every
+// mongosh version.
+const mongoOplogRangeScript = `
+const oplog = db.getSiblingDB("local").oplog.rs;
+const ts = e => (e.ts.getHighBits() >>> 0) + ":" + (e.ts.getLowBits() >>> 0);
+const first = oplog.find({}, {ts: 1}).sort({$natural: 1}).limit(1).next();
+const last = oplog.find({}, {ts: 1}).sort({$natural: -1}).limit(1).next();
+print(ts(first) + " " + ts(last));
+`
+
+// OplogRange returns the timestamps of the oldest and newest entries in the
+// oplog, which only replica set members have.
+func (db *MongoDatabase) OplogRange(ctx context.Context, config core.Config) (first, last MongoTimestamp, err error) {
+	cfg, err := parseMongoConfig(config)
+	if err != nil {
+		return first, last, err
+	}
+
+	out, err := mongoEval(ctx, cfg, mongoOplogRangeScript)
+	if err != nil {
+		return first, last, fmt.Errorf("failed to read the oplog (is this a replica set member?): %v", err)
+	}
+	f, l, _ := strings.Cut(out, " ")
+	if first, err = ParseMongoTimestamp(f); err != nil {
+		return first, last, fmt.Errorf("unexpected mongosh output: %s", out)
+	}
+	if last, err = ParseMongoTimestamp(l); err != nil {
+		return first, last, fmt.Errorf("unexpected mongosh output: %s", out)
+	}
+	return first, last, nil
+}
+
+// DumpOplog writes the oplog entries after from, up to and including to, to
+// w as BSON.
+func (db *MongoDatabase) DumpOplog(ctx context.Context, config core.Config, from, to MongoTimestamp, w io.Writer) error {
+	// mongodump --config=[file with uri] --db=local --collection=oplog.rs --query=[range] --out=- > [w]
+
+	cfg, err := parseMongoConfig(config)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`{"ts": {"$gt": {"$timestamp": {"t": %d, "i": %d}}, "$lte": {"$timestamp": {"t": %d, "i": %d}}}}`,
+		from.T, from.I, to.T, to.I)
+	cmd, cleanup, err := cfg.clusterCommand(ctx, "mongodump",
+		"--db=local",
+		"--collection=oplog.rs",
+		"--query="+query,
+		// A single collection can be written to stdout.
+		"--out=-",
+	)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdout = w
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mongodump of the oplog failed: %v", err)
+	}
+	return nil
+}
+
+// ReplayOplog applies the oplog entries read from r, slices written by
+// DumpOplog one after another, to the deployment. Replay stops before the
+// first entry at or after stop. Entries that are already applied are
+// applied again, which oplog entries allow.
+func (db *MongoDatabase) ReplayOplog(ctx context.Context, config core.Config, r io.Reader, stop time.Time) error {
+	// mongorestore --config=[file with uri] --oplogReplay --oplogLimit=[stop] [dir with oplog.bson]
+
+	cfg, err := parseMongoConfig(config)
+	if err != nil {
+		return err
+	}
+
+	// mongorestore only replays an oplog.bson at the top of a dump
+	// directory.
+	dir, err := os.MkdirTemp("", "mongo-oplog-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "oplog.bson"))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stage oplog: %v", err)
+	}
+
+	cmd, cleanup, err := cfg.clusterCommand(ctx, "mongorestore",
+		"--oplogReplay",
+		fmt.Sprintf("--oplogLimit=%d", stop.Unix()),
+		dir,
+	)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mongorestore --oplogReplay failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
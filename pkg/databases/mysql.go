@@ -1,72 +1,263 @@
 package databases
 
 import (
+	"bytes"
+	"context"
 	"db-backup-tool/pkg/core"
 	"fmt"
-	"os"
+	"io"
 	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 type MySQLDatabase struct{}
 
-func (db *MySQLDatabase) Backup(config core.Config, outputPath string) (string, error) {
+// MySQLConfig is the typed form of a `type: mysql` database entry
+type MySQLConfig struct {
+	ServerConfig `mapstructure:",squash"`
+	// SingleTransaction dumps InnoDB tables from a consistent snapshot
+	// without locking them.
+	SingleTransaction bool `mapstructure:"single_transaction"`
+	Routines          bool `mapstructure:"routines"`
+	Triggers          bool `mapstructure:"triggers"`
+	Events            bool `mapstructure:"events"`
+	HexBlob           bool `mapstructure:"hex_blob"`
+	// SetGTIDPurged is passed as --set-gtid-purged (AUTO, ON, OFF or
+	// COMMENTED) if set. MariaDB doesn't support it.
+	SetGTIDPurged string `mapstructure:"set_gtid_purged"`
+	// SourceData (--source-data) or MasterData (--master-data) writes the
+	// binlog coordinates into the dump: 1 as a CHANGE statement, 2 as a
+	// comment. They are recorded in the manifest, which point-in-time
+	// recovery needs, so SourceData defaults to 2 unless MasterData is set.
+	// mysqldump before 8.0.26 and MariaDB's get --master-data either way.
+	SourceData int `mapstructure:"source_data"`
+	MasterData int `mapstructure:"master_data"`
+	// ExtraArgs are appended to the mysqldump command line
+	ExtraArgs []string `mapstructure:"extra_args"`
+}
+
+func parseMySQLConfig(raw core.Config) (*MySQLConfig, error) {
+	cfg := &MySQLConfig{
+		ServerConfig:      ServerConfig{Host: "localhost", Port: 3306},
+		SingleTransaction: true,
+		Routines:          true,
+		Triggers:          true,
+		Events:            true,
+		HexBlob:           true,
+		SourceData:        2,
+	}
+	if _, ok := raw["master_data"]; ok {
+		cfg.SourceData = 0
+	}
+	if err := decodeConfig(raw, cfg, cfg.validate); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *MySQLConfig) validate() []error {
+	errs := c.ServerConfig.validate(true)
+	switch strings.ToUpper(c.SetGTIDPurged) {
+	case "", "AUTO", "ON", "OFF", "COMMENTED":
+	default:
+		errs = append(errs, &core.FieldError{Field: "set_gtid_purged", Msg: "must be AUTO, ON, OFF or COMMENTED"})
+	}
+	if c.SourceData < 0 || c.SourceData > 2 {
+		errs = append(errs, &core.FieldError{Field: "source_data", Msg: "must be 0, 1 or 2"})
+	}
+	if c.MasterData < 0 || c.MasterData > 2 {
+		errs = append(errs, &core.FieldError{Field: "master_data", Msg: "must be 0, 1 or 2"})
+	}
+	if c.SourceData != 0 && c.MasterData != 0 {
+		errs = append(errs, &core.FieldError{Field: "source_data", Msg: "can't be combined with master_data"})
+	}
+	return errs
+}
+
+// command returns a command for one of the mysql client tools. The
+// credentials are passed in a temporary option file rather than on the
+// command line, where any user could see them in ps; call cleanup once the
+// command has exited to remove it.
+func (c *MySQLConfig) command(ctx context.Context, name string, args ...string) (*exec.Cmd, func(), error) {
+	options := fmt.Sprintf("[client]\nuser=%s\npassword=%s\nhost=%s\nport=%d\n",
+		mysqlOptionValue(c.User), mysqlOptionValue(c.Password), mysqlOptionValue(c.Host), c.Port)
+	path, cleanup, err := secretFile("mysql-*.cnf", []byte(options))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write mysql option file: %v", err)
+	}
+
+	// --defaults-extra-file must be the first option.
+	cmd := exec.CommandContext(ctx, name, append([]string{"--defaults-extra-file=" + path}, args...)...)
+	return cmd, cleanup, nil
+}
+
+// mysqlOptionValue quotes a value for a mysql option file
+func mysqlOptionValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// dumpArgs returns the mysqldump options for the configured dump behaviour.
+// toolVersion is the output of mysqldump --version.
+func (c *MySQLConfig) dumpArgs(toolVersion string) []string {
+	var args []string
+	if c.SingleTransaction {
+		args = append(args, "--single-transaction")
+	}
+	if c.Routines {
+		args = append(args, "--routines")
+	}
+	if !c.Triggers {
+		args = append(args, "--skip-triggers")
+	}
+	if c.Events {
+		args = append(args, "--events")
+	}
+	if c.HexBlob {
+		args = append(args, "--hex-blob")
+	}
+	if c.SetGTIDPurged != "" {
+		args = append(args, "--set-gtid-purged="+strings.ToUpper(c.SetGTIDPurged))
+	}
+	if c.SourceData != 0 {
+		option := "--source-data"
+		if !mysqldumpHasSourceData(toolVersion) {
+			option = "--master-data"
+		}
+		args = append(args, fmt.Sprintf("%s=%d", option, c.SourceData))
+	}
+	if c.MasterData != 0 {
+		args = append(args, fmt.Sprintf("--master-data=%d", c.MasterData))
+	}
+	return append(args, c.ExtraArgs...)
+}
+
+// mysqldumpVersionPattern matches the version in mysqldump --version, e.g.
+// "Ver 8.0.36" or "Ver 10.13 Distrib 5.7.44"
+var mysqldumpVersionPattern = regexp.MustCompile(`(?:Ver|Distrib) (\d+)\.(\d+)\.(\d+)`)
+
+// mysqldumpHasSourceData reports whether the mysqldump that printed
+// version knows --source-data, which replaced --master-data in 8.0.26.
+// An unknown version is assumed to be recent.
+func mysqldumpHasSourceData(version string) bool {
+	if strings.Contains(version, "MariaDB") {
+		return false
+	}
+	m := mysqldumpVersionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return true
+	}
+	v := make([]int, 3)
+	for i := range v {
+		v[i], _ = strconv.Atoi(m[i+1])
+	}
+	return slices.Compare(v, []int{8, 0, 26}) >= 0
+}
+
+// mysqlBinlogEnabled reports whether the server writes binary logs. Without
+// them mysqldump refuses --source-data, and the coordinates would be of no
+// use anyway. If the server can't be asked, it is assumed to.
+func mysqlBinlogEnabled(ctx context.Context, config core.Config) bool {
+	logBin, err := mysqlQuery(ctx, config, "SELECT @@GLOBAL.log_bin")
+	return err != nil || logBin != "0"
+}
+
+func (db *MySQLDatabase) ValidateConfig(config core.Config) error {
+	_, err := parseMySQLConfig(config)
+	return err
+}
+
+func (db *MySQLDatabase) Backup(ctx context.Context, config core.Config, outputPath string) (string, error) {
+	return backupToFile(ctx, db, config, outputPath)
+}
+
+func (db *MySQLDatabase) BackupTo(ctx context.Context, config core.Config, w io.Writer) (core.BackupInfo, error) {
 	// Construct mysqldump command
-	// mysqldump -u [user] -p[password] -h [host] -P [port] [database] > [outputPath]
-
-	user := config["user"].(string)
-	password := config["password"].(string)
-	host := config["host"].(string)
-	port := config["port"].(int)
-	database := config["database"].(string)
-
-	cmd := exec.Command("mysqldump",
-		fmt.Sprintf("-u%s", user),
-		fmt.Sprintf("-p%s", password),
-		fmt.Sprintf("-h%s", host),
-		fmt.Sprintf("-P%d", port),
-		database,
-	)
+	// mysqldump --defaults-extra-file=[credentials] [options] [database] > [w]
+
+	var info core.BackupInfo
 
-	// Create output file
-	outfile, err := os.Create(outputPath)
+	cfg, err := parseMySQLConfig(config)
 	if err != nil {
-		return "", err
+		return info, err
 	}
-	defer outfile.Close()
 
-	cmd.Stdout = outfile
+	// Versions are best-effort and only recorded in the manifest
+	info.DumpToolVersion = commandVersion(ctx, "mysqldump")
+	info.ServerVersion, _ = mysqlQuery(ctx, config, "SELECT VERSION()")
+	if !mysqlBinlogEnabled(ctx, config) {
+		cfg.SourceData, cfg.MasterData = 0, 0
+	}
+
+	args := append(cfg.dumpArgs(info.DumpToolVersion), cfg.Database)
+
+	cmd, cleanup, err := cfg.command(ctx, "mysqldump", args...)
+	if err != nil {
+		return info, err
+	}
+	defer cleanup()
+
+	// The binlog coordinates are written near the top of the dump.
+	head := &headWriter{limit: 1 << 20}
+	cmd.Stdout = io.MultiWriter(w, head)
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("mysqldump failed: %v", err)
+		return info, fmt.Errorf("mysqldump failed: %v", err)
 	}
 
-	return outputPath, nil
+	info.Metadata = mysqlBinlogCoordinates(head.Bytes())
+	return info, nil
 }
 
-func (db *MySQLDatabase) Restore(config core.Config, backupPath string) error {
-	// mysql -u [user] -p[password] -h [host] -P [port] [database] < [backupPath]
+var (
+	// mysqlBinlogPattern matches the statement written by --source-data
+	// and --master-data
+	mysqlBinlogPattern = regexp.MustCompile(`(?:MASTER|SOURCE)_LOG_FILE='([^']+)',\s*(?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+	// mysqlGTIDPattern matches the statement written by --set-gtid-purged
+	mysqlGTIDPattern = regexp.MustCompile(`GTID_PURGED=(?:/\*!80000 '\+'\*/ )?'([^']*)'`)
+)
 
-	user := config["user"].(string)
-	password := config["password"].(string)
-	host := config["host"].(string)
-	port := config["port"].(int)
-	database := config["database"].(string)
+// mysqlBinlogCoordinates extracts the binlog position and GTID set a dump
+// starts at from its header. It returns nil if the dump records neither.
+func mysqlBinlogCoordinates(head []byte) map[string]string {
+	md := map[string]string{}
+	if m := mysqlBinlogPattern.FindSubmatch(head); m != nil {
+		md["binlog_file"] = string(m[1])
+		md["binlog_position"] = string(m[2])
+	}
+	if m := mysqlGTIDPattern.FindSubmatch(head); m != nil {
+		md["gtid_executed"] = strings.Join(strings.Fields(string(m[1])), "")
+	}
+	if len(md) == 0 {
+		return nil
+	}
+	return md
+}
 
-	cmd := exec.Command("mysql",
-		fmt.Sprintf("-u%s", user),
-		fmt.Sprintf("-p%s", password),
-		fmt.Sprintf("-h%s", host),
-		fmt.Sprintf("-P%d", port),
-		database,
-	)
+func (db *MySQLDatabase) Restore(ctx context.Context, config core.Config, backupPath string, opts core.RestoreOptions) error {
+	return restoreFromFile(ctx, db, config, backupPath, opts)
+}
+
+func (db *MySQLDatabase) RestoreFrom(ctx context.Context, config core.Config, r io.Reader, opts core.RestoreOptions) error {
+	// mysql --defaults-extra-file=[credentials] [database] < [r]
 
-	infile, err := os.Open(backupPath)
+	cfg, err := parseMySQLConfig(config)
 	if err != nil {
 		return err
 	}
-	defer infile.Close()
 
-	cmd.Stdin = infile
+	if err := mysqlPrepareDatabase(ctx, config, cfg.Database, opts); err != nil {
+		return err
+	}
+
+	cmd, cleanup, err := cfg.command(ctx, "mysql", cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdin = r
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("mysql restore failed: %v", err)
@@ -75,7 +266,169 @@ func (db *MySQLDatabase) Restore(config core.Config, backupPath string) error {
 	return nil
 }
 
-func (db *MySQLDatabase) TestConnection(config core.Config) error {
-	// mysqladmin -u [user] -p[password] -h [host] -P [port] ping
-	return nil // Dummy implementation
+func (db *MySQLDatabase) TestConnection(ctx context.Context, config core.Config) (core.ConnectionInfo, error) {
+	// mysqladmin --defaults-extra-file=[credentials] ping
+
+	var info core.ConnectionInfo
+
+	cfg, err := parseMySQLConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	cmd, cleanup, err := cfg.command(ctx, "mysqladmin", "ping")
+	if err != nil {
+		return info, err
+	}
+	defer cleanup()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return info, fmt.Errorf("mysqladmin ping failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	version, err := mysqlQuery(ctx, config, "SELECT VERSION()")
+	if err != nil {
+		return info, err
+	}
+	info.ServerVersion = version
+	if !mysqlBinlogEnabled(ctx, config) {
+		cfg.SourceData, cfg.MasterData = 0, 0
+	}
+
+	grants, err := mysqlQuery(ctx, config, "SHOW GRANTS FOR CURRENT_USER()")
+	if err != nil {
+		return info, err
+	}
+	info.CanDump, info.Detail = mysqlCanDump(strings.Split(grants, "\n"), cfg)
+
+	return info, nil
+}
+
+// mysqlPrepareDatabase drops and creates the target database as requested
+// by opts. The dump doesn't name the database, so it can be restored under
+// any name.
+func mysqlPrepareDatabase(ctx context.Context, config core.Config, database string, opts core.RestoreOptions) error {
+	name := mysqlQuoteIdent(database)
+	if opts.DropExisting {
+		if _, err := mysqlQuery(ctx, config, "DROP DATABASE IF EXISTS "+name); err != nil {
+			return fmt.Errorf("failed to drop database %s: %v", database, err)
+		}
+	}
+	if opts.CreateDatabase || opts.DropExisting {
+		if _, err := mysqlQuery(ctx, config, "CREATE DATABASE IF NOT EXISTS "+name); err != nil {
+			return fmt.Errorf("failed to create database %s: %v", database, err)
+		}
+	}
+	return nil
+}
+
+// mysqlQuoteIdent quotes a database or table name
+func mysqlQuoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// mysqlQuery runs a single query with the mysql client and returns the raw,
+// tab-separated result without column headers.
+func mysqlQuery(ctx context.Context, config core.Config, query string) (string, error) {
+	cfg, err := parseMySQLConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	cmd, cleanup, err := cfg.command(ctx, "mysql",
+		"--batch", "--skip-column-names",
+		"-e", query,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("mysql query failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// mysqlCanDump checks SHOW GRANTS output for the privileges mysqldump needs
+// with cfg's options: SELECT on the database, LOCK TABLES unless the dump
+// runs in a single transaction, SHOW_ROUTINE (or SELECT on mysql.proc)
+// for routines, TRIGGER and EVENT for triggers and events, and RELOAD and
+// REPLICATION CLIENT to read the binlog position or GTID set.
+func mysqlCanDump(grants []string, cfg *MySQLConfig) (bool, string) {
+	// Privileges held on *.*, on the database and on mysql.proc
+	global, onDatabase, onProc := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, grant := range grants {
+		upper := strings.ToUpper(grant)
+		onIdx := strings.Index(upper, " ON ")
+		if !strings.HasPrefix(upper, "GRANT ") || onIdx < 0 {
+			continue
+		}
+
+		var privs map[string]bool
+		target := strings.ReplaceAll(grant[onIdx+4:], "`", "")
+		switch {
+		case strings.HasPrefix(target, "*.*"):
+			privs = global
+		case strings.HasPrefix(target, cfg.Database+".*"):
+			privs = onDatabase
+		case strings.HasPrefix(target, "mysql.proc "), strings.HasPrefix(target, "mysql.* "):
+			privs = onProc
+		default:
+			continue
+		}
+		for _, priv := range strings.Split(upper[len("GRANT "):onIdx], ",") {
+			privs[strings.TrimSpace(priv)] = true
+		}
+	}
+
+	hasGlobal := func(priv string) bool {
+		return global[priv] || global["ALL PRIVILEGES"]
+	}
+	has := func(priv string) bool {
+		return hasGlobal(priv) || onDatabase[priv] || onDatabase["ALL PRIVILEGES"]
+	}
+
+	var missing []string
+	if !has("SELECT") {
+		missing = append(missing, "SELECT on "+cfg.Database)
+	}
+	if !cfg.SingleTransaction && !has("LOCK TABLES") {
+		missing = append(missing, "LOCK TABLES on "+cfg.Database)
+	}
+	if cfg.Routines && !hasGlobal("SHOW_ROUTINE") && !hasGlobal("SELECT") && !onProc["SELECT"] && !onProc["ALL PRIVILEGES"] {
+		missing = append(missing, "SHOW_ROUTINE or SELECT on mysql.proc (for routines)")
+	}
+	if cfg.Triggers && !has("TRIGGER") {
+		missing = append(missing, fmt.Sprintf("TRIGGER on %s (for triggers)", cfg.Database))
+	}
+	if cfg.Events && !has("EVENT") {
+		missing = append(missing, fmt.Sprintf("EVENT on %s (for events)", cfg.Database))
+	}
+
+	var coordinates string
+	switch {
+	case cfg.SourceData != 0:
+		coordinates = "source_data"
+	case cfg.MasterData != 0:
+		coordinates = "master_data"
+	case strings.EqualFold(cfg.SetGTIDPurged, "ON"):
+		coordinates = "set_gtid_purged"
+	}
+	if coordinates != "" {
+		if !hasGlobal("RELOAD") {
+			missing = append(missing, fmt.Sprintf("RELOAD (for %s)", coordinates))
+		}
+		// MariaDB 10.5 renamed REPLICATION CLIENT to BINLOG MONITOR.
+		if !hasGlobal("REPLICATION CLIENT") && !hasGlobal("BINLOG MONITOR") {
+			missing = append(missing, fmt.Sprintf("REPLICATION CLIENT (for %s)", coordinates))
+		}
+	}
+
+	if len(missing) > 0 {
+		return false, "user lacks " + strings.Join(missing, ", ")
+	}
+	return true, ""
 }
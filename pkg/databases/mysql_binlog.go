@@ -0,0 +1,176 @@
+package databases
+
+import (
+	"bytes"
+	"context"
+	"db-backup-tool/pkg/core"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// StreamBinlogs copies the server's binary logs into dir with mysqlbinlog,
+// starting at the beginning of startFile, and keeps appending to them until
+// ctx is cancelled or the connection fails. Files in dir are named like on
+// the server; every file but the newest is complete. serverID, if not 0, is
+// the replica server ID mysqlbinlog connects with; it must be unique among
+// the server's replicas.
+func (db *MySQLDatabase) StreamBinlogs(ctx context.Context, config core.Config, dir, startFile string, serverID int) error {
+	// mysqlbinlog --defaults-extra-file=[credentials] --read-from-remote-server --raw --stop-never --result-file=[dir]/ [start file]
+
+	cfg, err := parseMySQLConfig(config)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--read-from-remote-server",
+		"--raw",
+		"--stop-never",
+		// With --raw, the result file is a prefix for the binlog names.
+		"--result-file=" + dir + string(os.PathSeparator),
+	}
+	if serverID != 0 {
+		args = append(args, fmt.Sprintf("--connection-server-id=%d", serverID))
+	}
+	args = append(args, startFile)
+
+	cmd, cleanup, err := cfg.command(ctx, "mysqlbinlog", args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("mysqlbinlog failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return fmt.Errorf("mysqlbinlog exited unexpectedly: %s", strings.TrimSpace(string(out)))
+}
+
+const (
+	// binlogMagic starts every binlog file
+	binlogMagic = "\xfebin"
+	// binlogHeaderSize is the size of an event header, which holds the
+	// length of the whole event at offset 9
+	binlogHeaderSize = 19
+)
+
+// BinlogCompleteSize returns the size of the part of the binlog at path
+// that holds complete events. A binlog that is still being written may end
+// in part of an event, which mysqlbinlog fails on when it is replayed.
+// Scanning starts at from, which must be 0 or a size returned for the same
+// file before.
+func BinlogCompleteSize(path string, from int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	pos := from
+	if pos == 0 {
+		magic := make([]byte, len(binlogMagic))
+		if _, err := f.ReadAt(magic, 0); err == io.EOF {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(magic, []byte(binlogMagic)) {
+			return 0, fmt.Errorf("%s is not a binlog", path)
+		}
+		pos = int64(len(binlogMagic))
+	}
+
+	header := make([]byte, binlogHeaderSize)
+	for pos+binlogHeaderSize <= size {
+		if _, err := f.ReadAt(header, pos); err != nil {
+			return 0, err
+		}
+		length := int64(binary.LittleEndian.Uint32(header[9:13]))
+		if length < binlogHeaderSize {
+			return 0, fmt.Errorf("%s: invalid event length %d at position %d", path, length, pos)
+		}
+		if pos+length > size {
+			break
+		}
+		pos += length
+	}
+	return pos, nil
+}
+
+// ReplayBinlogs applies the events in files, which must be consecutive
+// binlogs, to the configured database. Replay starts at startPosition in
+// the first file, the position recorded with the dump that was restored,
+// and stops before the first event after stop. Only events for
+// opts.SourceDatabase are applied; they are rewritten to the configured
+// database if it has another name.
+func (db *MySQLDatabase) ReplayBinlogs(ctx context.Context, config core.Config, files []string, startPosition string, stop time.Time, opts core.RestoreOptions) error {
+	// mysqlbinlog --start-position=[pos] --stop-datetime=[time] [files] | mysql --defaults-extra-file=[credentials]
+
+	cfg, err := parseMySQLConfig(config)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no binlogs to replay")
+	}
+
+	source := opts.SourceDatabase
+	if source == "" {
+		source = cfg.Database
+	}
+	args := []string{
+		// The transactions are new to a server that was reset to the dump,
+		// so they must not be skipped as already executed.
+		"--skip-gtids",
+		"--start-position=" + startPosition,
+		// mysqlbinlog reads the stop time in the local time zone.
+		"--stop-datetime=" + stop.Local().Format("2006-01-02 15:04:05"),
+		// The rewrite happens before the --database filter.
+		"--database=" + cfg.Database,
+	}
+	if source != cfg.Database {
+		args = append(args, fmt.Sprintf("--rewrite-db=%s->%s", source, cfg.Database))
+	}
+	args = append(args, files...)
+
+	// Reading local files needs no credentials.
+	decode := exec.CommandContext(ctx, "mysqlbinlog", args...)
+	events, err := decode.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	apply, cleanup, err := cfg.command(ctx, "mysql")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	apply.Stdin = events
+
+	if err := decode.Start(); err != nil {
+		return fmt.Errorf("mysqlbinlog failed: %v", err)
+	}
+	if err := apply.Run(); err != nil {
+		decode.Process.Kill()
+		decode.Wait()
+		return fmt.Errorf("replaying binlogs failed: %v", err)
+	}
+	if err := decode.Wait(); err != nil {
+		return fmt.Errorf("mysqlbinlog failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package databases
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// binlogEvent returns an event of n bytes with a valid length in its header
+func binlogEvent(n int) []byte {
+	ev := make([]byte, n)
+	binary.LittleEndian.PutUint32(ev[9:13], uint32(n))
+	return ev
+}
+
+func TestBinlogCompleteSize(t *testing.T) {
+	// Events end at 4, 34, 134 and 153.
+	binlog := bytes.Join([][]byte{[]byte(binlogMagic), binlogEvent(30), binlogEvent(100), binlogEvent(binlogHeaderSize)}, nil)
+	invalid := bytes.Clone(binlog[:34])
+	invalid = append(invalid, binlogEvent(binlogHeaderSize)...)
+	binary.LittleEndian.PutUint32(invalid[34+9:], 5)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		from    int64
+		want    int64
+		wantErr bool
+	}{
+		{name: "empty", data: nil, want: 0},
+		{name: "part of the magic number", data: binlog[:2], want: 0},
+		{name: "magic number only", data: binlog[:4], want: 4},
+		{name: "complete", data: binlog, want: 153},
+		{name: "truncated event header", data: binlog[:34+10], want: 34},
+		{name: "truncated event body", data: binlog[:133], want: 34},
+		{name: "last event truncated", data: binlog[:152], want: 134},
+		{name: "resumed", data: binlog, from: 34, want: 153},
+		{name: "resumed at the end", data: binlog[:140], from: 134, want: 134},
+		{name: "not a binlog", data: []byte("-- MySQL dump"), wantErr: true},
+		{name: "invalid event length", data: invalid, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "binlog.000001")
+			if err := os.WriteFile(path, tt.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := BinlogCompleteSize(path, tt.from)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package databases
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"db-backup-tool/pkg/core"
+)
+
+func TestMySQLDumpArgsSourceData(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      core.Config
+		toolVersion string
+		want        []string
+		notWant     []string
+	}{
+		{
+			name:    "default",
+			config:  core.Config{},
+			want:    []string{"--source-data=2"},
+			notWant: []string{"--master-data=2"},
+		},
+		{
+			name:        "default with mysqldump before 8.0.26",
+			config:      core.Config{},
+			toolVersion: "mysqldump  Ver 8.0.25 for Linux on x86_64 (MySQL Community Server - GPL)",
+			want:        []string{"--master-data=2"},
+			notWant:     []string{"--source-data=2"},
+		},
+		{
+			name:    "master_data instead of the default",
+			config:  core.Config{"master_data": 1},
+			want:    []string{"--master-data=1"},
+			notWant: []string{"--source-data=2"},
+		},
+		{
+			name:    "disabled",
+			config:  core.Config{"source_data": 0},
+			notWant: []string{"--source-data=2", "--master-data=2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config["user"] = "backup"
+			tt.config["database"] = "app"
+			cfg, err := parseMySQLConfig(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := cfg.dumpArgs(tt.toolVersion)
+			for _, arg := range tt.want {
+				if !slices.Contains(args, arg) {
+					t.Errorf("%v lacks %s", args, arg)
+				}
+			}
+			for _, arg := range tt.notWant {
+				if slices.Contains(args, arg) {
+					t.Errorf("%v has %s", args, arg)
+				}
+			}
+		})
+	}
+}
+
+func TestMysqldumpHasSourceData(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"mysqldump  Ver 8.0.36 for Linux on x86_64 (MySQL Community Server - GPL)", true},
+		{"mysqldump  Ver 8.0.26 for Linux on x86_64 (MySQL Community Server - GPL)", true},
+		{"mysqldump  Ver 8.4.0 for Linux on aarch64 (MySQL Community Server - GPL)", true},
+		{"mysqldump  Ver 8.0.25 for Linux on x86_64 (MySQL Community Server - GPL)", false},
+		{"mysqldump  Ver 10.13 Distrib 5.7.44, for Linux (x86_64)", false},
+		{"mysqldump  Ver 10.19 Distrib 10.11.6-MariaDB, for debian-linux-gnu (x86_64)", false},
+		{"mysqldump from 11.4.2-MariaDB, client 10.19 for Linux (x86_64)", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := mysqldumpHasSourceData(tt.version); got != tt.want {
+			t.Errorf("mysqldumpHasSourceData(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestMySQLBinlogCoordinates(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want map[string]string
+	}{
+		{
+			name: "source_data 2",
+			head: "--\n-- Position to start replication or point-in-time recovery from\n--\n\n" +
+				"-- CHANGE REPLICATION SOURCE TO SOURCE_LOG_FILE='binlog.000042', SOURCE_LOG_POS=1337;\n",
+			want: map[string]string{"binlog_file": "binlog.000042", "binlog_position": "1337"},
+		},
+		{
+			name: "source_data 1",
+			head: "CHANGE REPLICATION SOURCE TO SOURCE_LOG_FILE='binlog.000042', SOURCE_LOG_POS=1337;\n",
+			want: map[string]string{"binlog_file": "binlog.000042", "binlog_position": "1337"},
+		},
+		{
+			name: "master_data 2",
+			head: "-- CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000003', MASTER_LOG_POS=154;\n",
+			want: map[string]string{"binlog_file": "mysql-bin.000003", "binlog_position": "154"},
+		},
+		{
+			name: "MariaDB master_data",
+			head: "-- CHANGE MASTER TO MASTER_LOG_FILE='mariadb-bin.000002', MASTER_LOG_POS=342;\n" +
+				"-- SET GLOBAL gtid_slave_pos='0-1-2';\n",
+			want: map[string]string{"binlog_file": "mariadb-bin.000002", "binlog_position": "342"},
+		},
+		{
+			name: "GTID set over several lines",
+			head: "SET @@GLOBAL.GTID_PURGED=/*!80000 '+'*/ '3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5,\n" +
+				"3E11FA47-71CA-11E1-9E33-C80AA9429563:1-77';\n" +
+				"-- CHANGE REPLICATION SOURCE TO SOURCE_LOG_FILE='binlog.000042', SOURCE_LOG_POS=1337;\n",
+			want: map[string]string{
+				"binlog_file":     "binlog.000042",
+				"binlog_position": "1337",
+				"gtid_executed":   "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5,3E11FA47-71CA-11E1-9E33-C80AA9429563:1-77",
+			},
+		},
+		{
+			name: "GTID set before MySQL 8.0",
+			head: "SET @@GLOBAL.GTID_PURGED='3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5';\n",
+			want: map[string]string{"gtid_executed": "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5"},
+		},
+		{
+			name: "no coordinates",
+			head: "-- MySQL dump 10.13\nCREATE TABLE t (i int);\n",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mysqlBinlogCoordinates([]byte(tt.head))
+			if !maps.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,67 +1,325 @@
 package databases
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/utils"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 type PostgresDatabase struct{}
 
-func (db *PostgresDatabase) Backup(config core.Config, outputPath string) (string, error) {
-	// pg_dump -U [user] -h [host] -p [port] [database] > [outputPath]
-	// Password is usually supplied via PGPASSWORD env var
-
-	user := config["user"].(string)
-	password := config["password"].(string)
-	host := config["host"].(string)
-	port := config["port"].(int)
-	database := config["database"].(string)
-
-	cmd := exec.Command("pg_dump",
-		fmt.Sprintf("-U%s", user),
-		fmt.Sprintf("-h%s", host),
-		fmt.Sprintf("-p%d", port),
-		database,
-	)
+// pg_dump output formats
+const (
+	PostgresFormatPlain     = "plain"
+	PostgresFormatCustom    = "custom"
+	PostgresFormatDirectory = "directory"
+	// PostgresFormatBaseBackup is a physical copy of the whole cluster
+	// taken with pg_basebackup, see postgres_wal.go
+	PostgresFormatBaseBackup = "basebackup"
+)
+
+// PostgresConfig is the typed form of a `type: postgres` database entry
+type PostgresConfig struct {
+	ServerConfig `mapstructure:",squash"`
+	// Format is "plain" (SQL restored with psql), "custom" or "directory"
+	// (archives restored with pg_restore). Directory dumps are stored as a
+	// tar of the dump directory. "basebackup" takes a physical backup of
+	// the cluster instead.
+	Format string `mapstructure:"format"`
+	// Jobs is the number of parallel pg_dump (directory format only) and
+	// pg_restore workers.
+	Jobs int `mapstructure:"jobs"`
+	// Clean drops objects before recreating them (--clean --if-exists), so
+	// a restore can be re-run over an existing database.
+	Clean        bool `mapstructure:"clean"`
+	NoOwner      bool `mapstructure:"no_owner"`
+	NoPrivileges bool `mapstructure:"no_privileges"`
+	// Globals also backs up roles and tablespaces with pg_dumpall
+	// --globals-only, so the database can be restored on a fresh server.
+	Globals bool `mapstructure:"globals"`
+	// AllDatabases backs up the whole cluster, globals included, with
+	// pg_dumpall instead of a single database with pg_dump.
+	AllDatabases bool `mapstructure:"all_databases"`
+	// UsePassfile passes the password in a temporary PGPASSFILE instead of
+	// the PGPASSWORD environment variable.
+	UsePassfile bool `mapstructure:"use_passfile"`
+	// DataDirectory is where base backups are restored; the server must
+	// be stopped.
+	DataDirectory string `mapstructure:"data_directory"`
+}
+
+func parsePostgresConfig(raw core.Config) (*PostgresConfig, error) {
+	cfg := &PostgresConfig{
+		ServerConfig: ServerConfig{Host: "localhost", Port: 5432},
+		Format:       PostgresFormatPlain,
+		Jobs:         1,
+	}
+	validate := func() []error {
+		if (cfg.AllDatabases || cfg.Format == PostgresFormatBaseBackup) && cfg.Database == "" {
+			// Queries and restores of cluster dumps connect here.
+			cfg.Database = postgresMaintenanceDB
+		}
+		return cfg.validate()
+	}
+	if err := decodeConfig(raw, cfg, validate); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *PostgresConfig) validate() []error {
+	errs := c.ServerConfig.validate(true)
+	if c.AllDatabases && c.Format != PostgresFormatPlain {
+		errs = append(errs, &core.FieldError{Field: "format", Msg: "all_databases only supports the plain format"})
+	}
+	switch c.Format {
+	case PostgresFormatPlain, PostgresFormatCustom, PostgresFormatDirectory, PostgresFormatBaseBackup:
+	default:
+		errs = append(errs, &core.FieldError{Field: "format", Msg: `must be "plain", "custom", "directory" or "basebackup"`})
+	}
+	if c.Jobs < 1 {
+		errs = append(errs, &core.FieldError{Field: "jobs", Msg: "must be at least 1"})
+	} else if c.Jobs > 1 && (c.Format == PostgresFormatPlain || c.Format == PostgresFormatBaseBackup) {
+		errs = append(errs, &core.FieldError{Field: "jobs", Msg: "parallel jobs need the custom or directory format"})
+	}
+	return errs
+}
+
+// objectOptions returns the --clean, --no-owner and --no-privileges flags
+// shared by pg_dump and pg_restore.
+func (c *PostgresConfig) objectOptions() []string {
+	var args []string
+	if c.Clean {
+		args = append(args, "--clean", "--if-exists")
+	}
+	if c.NoOwner {
+		args = append(args, "--no-owner")
+	}
+	if c.NoPrivileges {
+		args = append(args, "--no-privileges")
+	}
+	return args
+}
+
+// connArgs returns the connection flags for the postgres client tools
+func (c *PostgresConfig) connArgs() []string {
+	return []string{
+		fmt.Sprintf("-U%s", c.User),
+		fmt.Sprintf("-h%s", c.Host),
+		fmt.Sprintf("-p%d", c.Port),
+	}
+}
 
-	// Set PGPASSWORD environment variable for this command
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", password))
+// command returns a command for one of the postgres client tools with the
+// password in its environment, or in a temporary password file if
+// use_passfile is set. Call cleanup once the command has exited.
+func (c *PostgresConfig) command(ctx context.Context, name string, args ...string) (*exec.Cmd, func(), error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if !c.UsePassfile {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", c.Password))
+		return cmd, func() {}, nil
+	}
 
-	outfile, err := os.Create(outputPath)
+	// hostname:port:database:username:password
+	escape := strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace
+	entry := fmt.Sprintf("%s:%d:*:%s:%s\n", escape(c.Host), c.Port, escape(c.User), escape(c.Password))
+	path, cleanup, err := secretFile("pgpass-*", []byte(entry))
 	if err != nil {
-		return "", err
+		return nil, nil, fmt.Errorf("failed to write password file: %v", err)
+	}
+	cmd.Env = append(os.Environ(), "PGPASSFILE="+path)
+	return cmd, cleanup, nil
+}
+
+func (db *PostgresDatabase) ValidateConfig(config core.Config) error {
+	_, err := parsePostgresConfig(config)
+	return err
+}
+
+func (db *PostgresDatabase) Backup(ctx context.Context, config core.Config, outputPath string) (string, error) {
+	return backupToFile(ctx, db, config, outputPath)
+}
+
+// DumpExt returns the artifact extension for the configured format
+func (db *PostgresDatabase) DumpExt(config core.Config) string {
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return "sql"
+	}
+	switch cfg.Format {
+	case PostgresFormatCustom:
+		return "dump"
+	case PostgresFormatDirectory, PostgresFormatBaseBackup:
+		return "tar"
+	default:
+		return "sql"
+	}
+}
+
+func (db *PostgresDatabase) BackupTo(ctx context.Context, config core.Config, w io.Writer) (core.BackupInfo, error) {
+	// pg_dump -U [user] -h [host] -p [port] -F[p|c|d] [database] > [w]
+	// The password is passed in PGPASSWORD or a temporary PGPASSFILE
+
+	var info core.BackupInfo
+
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	// Versions are best-effort and only recorded in the manifest
+	info.DumpToolVersion = commandVersion(ctx, "pg_dump")
+	info.ServerVersion, _ = postgresQuery(ctx, config, "SHOW server_version")
+	info.Metadata = map[string]string{"format": cfg.Format}
+
+	if cfg.AllDatabases {
+		info.DumpToolVersion = commandVersion(ctx, "pg_dumpall")
+		info.Metadata["all_databases"] = "true"
+
+		args := append(cfg.connArgs(), cfg.objectOptions()...)
+		cmd, cleanup, err := cfg.command(ctx, "pg_dumpall", args...)
+		if err != nil {
+			return info, err
+		}
+		defer cleanup()
+		cmd.Stdout = w
+		if err := cmd.Run(); err != nil {
+			return info, fmt.Errorf("pg_dumpall failed: %v", err)
+		}
+		return info, nil
+	}
+
+	if cfg.Format == PostgresFormatBaseBackup {
+		info.DumpToolVersion = commandVersion(ctx, "pg_basebackup")
+		return info, postgresBaseBackup(ctx, cfg, w, info.Metadata)
 	}
-	defer outfile.Close()
 
-	cmd.Stdout = outfile
+	args := cfg.connArgs()
+	switch cfg.Format {
+	case PostgresFormatPlain:
+		// Plain dumps are replayed as is, so the object options have to be
+		// applied now.
+		args = append(args, "-Fp")
+		args = append(args, cfg.objectOptions()...)
+	case PostgresFormatCustom:
+		// The archive is gzipped by the pipeline, so pg_dump's own
+		// compression is turned off.
+		args = append(args, "-Fc", "-Z0")
+	case PostgresFormatDirectory:
+		return info, postgresDumpDirectory(ctx, cfg, w)
+	}
+	args = append(args, cfg.Database)
+
+	cmd, cleanup, err := cfg.command(ctx, "pg_dump", args...)
+	if err != nil {
+		return info, err
+	}
+	defer cleanup()
+	cmd.Stdout = w
 
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("pg_dump failed: %v", err)
+		return info, fmt.Errorf("pg_dump failed: %v", err)
 	}
 
-	return outputPath, nil
+	return info, nil
 }
 
-func (db *PostgresDatabase) Restore(config core.Config, backupPath string) error {
-	// psql -U [user] -h [host] -p [port] -d [database] -f [backupPath]
+// postgresDumpDirectory runs a parallel directory format dump into a
+// temporary directory and writes it to w as a tar stream.
+func postgresDumpDirectory(ctx context.Context, cfg *PostgresConfig, w io.Writer) error {
+	tmp, err := os.MkdirTemp("", "pg_dump-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
 
-	user := config["user"].(string)
-	password := config["password"].(string)
-	host := config["host"].(string)
-	port := config["port"].(int)
-	database := config["database"].(string)
+	// pg_dump insists on creating the directory itself.
+	dir := filepath.Join(tmp, "dump")
+	args := append(cfg.connArgs(), "-Fd", "-Z0", fmt.Sprintf("-j%d", cfg.Jobs), "-f", dir, cfg.Database)
+	cmd, cleanup, err := cfg.command(ctx, "pg_dump", args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pg_dump failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
 
-	cmd := exec.Command("psql",
-		fmt.Sprintf("-U%s", user),
-		fmt.Sprintf("-h%s", host),
-		fmt.Sprintf("-p%d", port),
-		"-d", database,
-		"-f", backupPath,
-	)
+	if err := utils.TarDir(ctx, w, dir); err != nil {
+		return fmt.Errorf("failed to archive dump directory: %v", err)
+	}
+	return nil
+}
+
+func (db *PostgresDatabase) Restore(ctx context.Context, config core.Config, backupPath string, opts core.RestoreOptions) error {
+	return restoreFromFile(ctx, db, config, backupPath, opts)
+}
+
+func (db *PostgresDatabase) RestoreFrom(ctx context.Context, config core.Config, r io.Reader, opts core.RestoreOptions) error {
+	// psql -U [user] -h [host] -p [port] -d [database] < [r]
+	// pg_restore -U [user] -h [host] -p [port] -d [database] -j [jobs] [archive]
+
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return err
+	}
+
+	// The stored format is recognised by its header rather than taken
+	// from the config, which may have changed since the backup.
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read backup: %v", err)
+	}
 
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", password))
+	if isBaseBackup(prefix) {
+		// Base backups replace the data directory, not a database.
+		return postgresRestoreBaseBackup(ctx, cfg, br, opts)
+	}
+	if bytes.Contains(prefix, []byte(postgresClusterDumpMagic)) {
+		// A pg_dumpall script creates the databases itself.
+		return postgresRunScript(ctx, cfg, postgresMaintenanceDB, br)
+	}
+	if cfg.AllDatabases && cfg.Database == postgresMaintenanceDB {
+		return fmt.Errorf("single database backups can't be restored without a database name when all_databases is set")
+	}
+
+	if err := postgresPrepareDatabase(ctx, config, cfg.Database, opts); err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(prefix, []byte(postgresArchiveMagic)):
+		return postgresRestoreArchive(ctx, cfg, br)
+	case utils.IsTar(prefix):
+		return postgresRestoreDirectory(ctx, cfg, br)
+	}
+
+	return postgresRunScript(ctx, cfg, cfg.Database, br)
+}
+
+// postgresArchiveMagic starts every custom format archive
+const postgresArchiveMagic = "PGDMP"
+
+// postgresClusterDumpMagic is in the header comment of pg_dumpall output
+const postgresClusterDumpMagic = "-- PostgreSQL database cluster dump"
+
+// postgresRunScript replays a SQL script with psql
+func postgresRunScript(ctx context.Context, cfg *PostgresConfig, database string, r io.Reader) error {
+	cmd, cleanup, err := cfg.command(ctx, "psql", append(cfg.connArgs(), "-d", database)...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdin = r
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("psql restore failed: %v", err)
@@ -70,6 +328,231 @@ func (db *PostgresDatabase) Restore(config core.Config, backupPath string) error
 	return nil
 }
 
-func (db *PostgresDatabase) TestConnection(config core.Config) error {
-	return nil // Dummy implementation
+func (db *PostgresDatabase) WantsGlobals(config core.Config) bool {
+	cfg, err := parsePostgresConfig(config)
+	// Cluster dumps and base backups already contain the globals.
+	return err == nil && cfg.Globals && !cfg.AllDatabases && cfg.Format != PostgresFormatBaseBackup
+}
+
+func (db *PostgresDatabase) BackupGlobalsTo(ctx context.Context, config core.Config, w io.Writer) error {
+	// pg_dumpall -U [user] -h [host] -p [port] --globals-only > [w]
+
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return err
+	}
+
+	cmd, cleanup, err := cfg.command(ctx, "pg_dumpall", append(cfg.connArgs(), "--globals-only")...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdout = w
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dumpall --globals-only failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (db *PostgresDatabase) RestoreGlobalsFrom(ctx context.Context, config core.Config, r io.Reader) error {
+	// psql -U [user] -h [host] -p [port] -d postgres < [r]
+	// Roles that already exist are reported by psql and skipped.
+
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return err
+	}
+	return postgresRunScript(ctx, cfg, postgresMaintenanceDB, r)
+}
+
+// postgresRestoreArchive restores a custom format archive. pg_restore can
+// read it from stdin, but parallel restores need a seekable file.
+func postgresRestoreArchive(ctx context.Context, cfg *PostgresConfig, r io.Reader) error {
+	if cfg.Jobs <= 1 {
+		return pgRestore(ctx, cfg, r, "")
+	}
+
+	f, err := os.CreateTemp("", "pg_restore-*.dump")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, utils.NewContextReader(ctx, r))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stage archive: %v", err)
+	}
+	return pgRestore(ctx, cfg, nil, f.Name())
+}
+
+// postgresRestoreDirectory unpacks a directory format dump into a temporary
+// directory and restores it.
+func postgresRestoreDirectory(ctx context.Context, cfg *PostgresConfig, r io.Reader) error {
+	dir, err := os.MkdirTemp("", "pg_restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := utils.UntarDir(ctx, r, dir); err != nil {
+		return fmt.Errorf("failed to unpack dump directory: %v", err)
+	}
+	return pgRestore(ctx, cfg, nil, dir)
+}
+
+// pgRestore runs pg_restore on path, or on stdin if path is empty
+func pgRestore(ctx context.Context, cfg *PostgresConfig, stdin io.Reader, path string) error {
+	args := append(cfg.connArgs(), "-d", cfg.Database)
+	args = append(args, cfg.objectOptions()...)
+	if cfg.Jobs > 1 && path != "" {
+		args = append(args, fmt.Sprintf("-j%d", cfg.Jobs))
+	}
+	if path != "" {
+		args = append(args, path)
+	}
+
+	cmd, cleanup, err := cfg.command(ctx, "pg_restore", args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdin = stdin
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_restore failed: %v", err)
+	}
+	return nil
+}
+
+func (db *PostgresDatabase) TestConnection(ctx context.Context, config core.Config) (core.ConnectionInfo, error) {
+	// pg_isready -U [user] -h [host] -p [port] -d [database]
+
+	var info core.ConnectionInfo
+
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	cmd := exec.CommandContext(ctx, "pg_isready",
+		fmt.Sprintf("-U%s", cfg.User),
+		fmt.Sprintf("-h%s", cfg.Host),
+		fmt.Sprintf("-p%d", cfg.Port),
+		"-d", cfg.Database,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return info, fmt.Errorf("pg_isready failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// pg_isready doesn't authenticate, so run a real query as well.
+	version, err := postgresQuery(ctx, config, "SHOW server_version")
+	if err != nil {
+		return info, err
+	}
+	info.ServerVersion = version
+
+	if cfg.Format == PostgresFormatBaseBackup {
+		// pg_basebackup connects for replication.
+		replication, err := postgresQuery(ctx, config, "SELECT rolreplication OR rolsuper FROM pg_roles WHERE rolname = current_user")
+		if err != nil {
+			return info, err
+		}
+		info.CanDump = replication == "t"
+		if !info.CanDump {
+			info.Detail = "user lacks the REPLICATION attribute"
+		}
+		return info, nil
+	}
+
+	// pg_dump needs SELECT on every table and sequence in the database.
+	unreadable, err := postgresQuery(ctx, config, `
+		SELECT count(*) FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'v', 'm', 'S')
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND n.nspname NOT LIKE 'pg_toast%'
+		  AND NOT has_table_privilege(c.oid, 'SELECT')`)
+	if err != nil {
+		return info, err
+	}
+	info.CanDump = unreadable == "0"
+	if !info.CanDump {
+		info.Detail = fmt.Sprintf("user lacks SELECT on %s relation(s)", unreadable)
+	}
+
+	return info, nil
+}
+
+// postgresMaintenanceDB is connected to while the target database is dropped
+// or created, since neither can be done from inside it.
+const postgresMaintenanceDB = "postgres"
+
+// postgresPrepareDatabase drops and creates the target database as requested
+// by opts. pg_dump's plain output doesn't name the database, so it can be
+// restored under any name.
+func postgresPrepareDatabase(ctx context.Context, config core.Config, database string, opts core.RestoreOptions) error {
+	if !opts.CreateDatabase && !opts.DropExisting {
+		return nil
+	}
+	admin := withDatabase(config, postgresMaintenanceDB)
+
+	if opts.DropExisting {
+		if _, err := postgresQuery(ctx, admin, "DROP DATABASE IF EXISTS "+postgresQuoteIdent(database)); err != nil {
+			return fmt.Errorf("failed to drop database %s: %v", database, err)
+		}
+	} else {
+		n, err := postgresQuery(ctx, admin, "SELECT count(*) FROM pg_database WHERE datname = "+postgresQuoteLiteral(database))
+		if err != nil {
+			return err
+		}
+		if n != "0" {
+			return nil
+		}
+	}
+
+	if _, err := postgresQuery(ctx, admin, "CREATE DATABASE "+postgresQuoteIdent(database)); err != nil {
+		return fmt.Errorf("failed to create database %s: %v", database, err)
+	}
+	return nil
+}
+
+func postgresQuoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func postgresQuoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// postgresQuery runs a single query with psql and returns the unaligned,
+// tuples-only result.
+func postgresQuery(ctx context.Context, config core.Config, query string) (string, error) {
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	args := append(cfg.connArgs(),
+		"-d", cfg.Database,
+		"-X", "-t", "-A",
+		"-c", query,
+	)
+	cmd, cleanup, err := cfg.command(ctx, "psql", args...)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("psql query failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
 }
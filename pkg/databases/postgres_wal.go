@@ -0,0 +1,221 @@
+package databases
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/utils"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pg_basebackup -v reports the WAL range the backup needs, e.g.
+// "write-ahead log start point: 0/2000028 on timeline 1".
+var (
+	postgresWALStartPattern = regexp.MustCompile(`write-ahead log start point: ([0-9A-Fa-f]+/[0-9A-Fa-f]+) on timeline (\d+)`)
+	postgresWALEndPattern   = regexp.MustCompile(`write-ahead log end point: ([0-9A-Fa-f]+/[0-9A-Fa-f]+)`)
+)
+
+// postgresBaseBackup takes a physical backup of the cluster with
+// pg_basebackup and writes it to w as a tar of the tar files pg_basebackup
+// creates: base.tar with the data directory, pg_wal.tar with the WAL needed
+// to make it consistent, and backup_manifest. The WAL range is recorded in
+// metadata.
+func postgresBaseBackup(ctx context.Context, cfg *PostgresConfig, w io.Writer, metadata map[string]string) error {
+	// pg_basebackup -U [user] -h [host] -p [port] -D [dir] -Ft -Xstream -v
+
+	tmp, err := os.MkdirTemp("", "pg_basebackup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// pg_basebackup can only write a single tar to stdout, without the WAL
+	// streamed next to it, so the backup is staged on disk.
+	dir := filepath.Join(tmp, "base")
+	args := append(cfg.connArgs(),
+		"-D", dir,
+		"-Ft",
+		"-Xstream",
+		"--no-sync",
+		"--label=backup-tool",
+		"-v",
+	)
+	cmd, cleanup, err := cfg.command(ctx, "pg_basebackup", args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pg_basebackup failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if m := postgresWALStartPattern.FindSubmatch(out); m != nil {
+		metadata["start_lsn"] = string(m[1])
+		metadata["timeline"] = string(m[2])
+	}
+	if m := postgresWALEndPattern.FindSubmatch(out); m != nil {
+		metadata["stop_lsn"] = string(m[1])
+	}
+
+	if err := utils.TarDir(ctx, w, dir); err != nil {
+		return fmt.Errorf("failed to archive base backup: %v", err)
+	}
+	return nil
+}
+
+// isBaseBackup reports whether prefix, the first 512 bytes of a stream,
+// starts a base backup written by postgresBaseBackup. TarDir writes entries
+// in name order, so the first one is backup_manifest, or base.tar for
+// servers before PostgreSQL 13.
+func isBaseBackup(prefix []byte) bool {
+	if !utils.IsTar(prefix) {
+		return false
+	}
+	name, _, _ := bytes.Cut(prefix[:100], []byte{0})
+	return string(name) == "backup_manifest" || string(name) == "base.tar"
+}
+
+// postgresRestoreBaseBackup unpacks a base backup into the configured data
+// directory. The server must be stopped; an existing data directory is only
+// replaced with opts.DropExisting.
+func postgresRestoreBaseBackup(ctx context.Context, cfg *PostgresConfig, r io.Reader, opts core.RestoreOptions) error {
+	dir := cfg.DataDirectory
+	if dir == "" {
+		return &core.FieldError{Field: "data_directory", Msg: "is required to restore a base backup"}
+	}
+	if err := postgresPrepareDataDirectory(dir, opts.DropExisting); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(utils.NewContextReader(ctx, r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read base backup: %v", err)
+		}
+
+		switch hdr.Name {
+		case "base.tar":
+			err = utils.UntarDir(ctx, tr, dir)
+		case "pg_wal.tar":
+			err = utils.UntarDir(ctx, tr, filepath.Join(dir, "pg_wal"))
+		case "backup_manifest":
+			// Only needed by pg_verifybackup.
+		default:
+			return fmt.Errorf("base backups with tablespaces are not supported (found %s)", hdr.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unpack %s: %v", hdr.Name, err)
+		}
+	}
+}
+
+// postgresPrepareDataDirectory makes sure dir exists and is empty, emptying
+// it first if drop is set.
+func postgresPrepareDataDirectory(dir string, drop bool) error {
+	if _, err := os.Stat(filepath.Join(dir, "postmaster.pid")); err == nil {
+		return fmt.Errorf("the server using %s appears to be running, stop it first", dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		if !drop {
+			return fmt.Errorf("data directory %s is not empty, use --drop-existing to replace it", dir)
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The server refuses data directories that others can read.
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(dir, 0700)
+}
+
+// PostgresRecoveryTarget is where WAL replay stops. Exactly one field is
+// set.
+type PostgresRecoveryTarget struct {
+	Time time.Time
+	LSN  string
+}
+
+// WriteRecoveryConfig sets up the restored data directory for archive
+// recovery (PostgreSQL 12 and later): WAL is fetched with restoreCommand
+// and replayed up to target, and then the server is promoted.
+func (db *PostgresDatabase) WriteRecoveryConfig(config core.Config, restoreCommand string, target PostgresRecoveryTarget) error {
+	cfg, err := parsePostgresConfig(config)
+	if err != nil {
+		return err
+	}
+	if cfg.DataDirectory == "" {
+		return &core.FieldError{Field: "data_directory", Msg: "is required for point-in-time recovery"}
+	}
+
+	settings := [][2]string{{"restore_command", restoreCommand}}
+	if target.LSN != "" {
+		settings = append(settings, [2]string{"recovery_target_lsn", target.LSN})
+	} else {
+		settings = append(settings, [2]string{"recovery_target_time", target.Time.Format("2006-01-02 15:04:05.999999-07:00")})
+	}
+	settings = append(settings, [2]string{"recovery_target_action", "promote"})
+
+	// Settings later in postgresql.auto.conf override earlier ones.
+	var b strings.Builder
+	b.WriteString("\n# Point-in-time recovery, added by backup-tool restore\n")
+	for _, s := range settings {
+		fmt.Fprintf(&b, "%s = %s\n", s[0], postgresConfLiteral(s[1]))
+	}
+
+	f, err := os.OpenFile(filepath.Join(cfg.DataDirectory, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(b.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// recovery.signal starts the server in targeted recovery.
+	return os.WriteFile(filepath.Join(cfg.DataDirectory, "recovery.signal"), nil, 0600)
+}
+
+// postgresConfLiteral quotes s for postgresql.conf, where backslashes
+// escape the next character.
+func postgresConfLiteral(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(s) + "'"
+}
+
+// ParseLSN parses a WAL location such as 0/2000028
+func ParseLSN(s string) (uint64, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if ok {
+		h, errH := strconv.ParseUint(hi, 16, 32)
+		l, errL := strconv.ParseUint(lo, 16, 32)
+		if errH == nil && errL == nil {
+			return h<<32 | l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid LSN %q, expected e.g. 0/2000028", s)
+}
@@ -0,0 +1,471 @@
+package databases
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/utils"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis backup methods
+const (
+	// RedisMethodBGSave has the server write a snapshot with BGSAVE and
+	// copies it from data_directory, so the server must be local.
+	RedisMethodBGSave = "bgsave"
+	// RedisMethodRDB streams a snapshot over the replication protocol with
+	// redis-cli --rdb, which also works for remote servers.
+	RedisMethodRDB = "rdb"
+)
+
+type RedisDatabase struct{}
+
+// RedisConfig is the typed form of a `type: redis` database entry. A backup
+// holds every logical database of the server, so there is no database
+// setting.
+type RedisConfig struct {
+	Host string `mapstructure:"host"`
+	Port int    `mapstructure:"port"`
+	// User is the ACL user; without one, Password authenticates the
+	// default user (requirepass).
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	Method   string `mapstructure:"method"`
+	// DataDirectory is the server's dir, where BGSAVE writes the snapshot
+	// and restore stages it.
+	DataDirectory string `mapstructure:"data_directory"`
+	// RDBFilename is the server's dbfilename
+	RDBFilename string `mapstructure:"rdb_filename"`
+
+	TLS           bool   `mapstructure:"tls"`
+	TLSCACert     string `mapstructure:"tls_ca_cert"`
+	TLSCert       string `mapstructure:"tls_cert"`
+	TLSKey        string `mapstructure:"tls_key"`
+	TLSServerName string `mapstructure:"tls_server_name"`
+	// TLSInsecure skips verification of the server certificate
+	TLSInsecure bool `mapstructure:"tls_insecure"`
+}
+
+func parseRedisConfig(raw core.Config) (*RedisConfig, error) {
+	cfg := &RedisConfig{
+		Host:        "localhost",
+		Port:        6379,
+		Method:      RedisMethodBGSave,
+		RDBFilename: "dump.rdb",
+	}
+	if err := decodeConfig(raw, cfg, cfg.validate); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *RedisConfig) validate() []error {
+	var errs []error
+	if c.Host == "" {
+		errs = append(errs, &core.FieldError{Field: "host", Msg: "is required"})
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, &core.FieldError{Field: "port", Msg: "must be between 1 and 65535"})
+	}
+	switch c.Method {
+	case RedisMethodBGSave:
+		if c.DataDirectory == "" {
+			errs = append(errs, &core.FieldError{Field: "data_directory", Msg: "is required with method bgsave"})
+		}
+	case RedisMethodRDB:
+	default:
+		errs = append(errs, &core.FieldError{Field: "method", Msg: fmt.Sprintf("must be %s or %s, got %q", RedisMethodBGSave, RedisMethodRDB, c.Method)})
+	}
+	if c.RDBFilename == "" || strings.ContainsAny(c.RDBFilename, `/\`) {
+		errs = append(errs, &core.FieldError{Field: "rdb_filename", Msg: "must be a file name"})
+	}
+	if !c.TLS {
+		for _, f := range []struct {
+			field string
+			set   bool
+		}{
+			{"tls_ca_cert", c.TLSCACert != ""},
+			{"tls_cert", c.TLSCert != ""},
+			{"tls_key", c.TLSKey != ""},
+			{"tls_server_name", c.TLSServerName != ""},
+			{"tls_insecure", c.TLSInsecure},
+		} {
+			if f.set {
+				errs = append(errs, &core.FieldError{Field: f.field, Msg: "requires tls: true"})
+			}
+		}
+	}
+	if c.TLSCert != "" && c.TLSKey == "" {
+		errs = append(errs, &core.FieldError{Field: "tls_cert", Msg: "requires tls_key"})
+	}
+	if c.TLSKey != "" && c.TLSCert == "" {
+		errs = append(errs, &core.FieldError{Field: "tls_key", Msg: "requires tls_cert"})
+	}
+	return errs
+}
+
+// redisAuthEnv passes the password to redis-cli, which otherwise only takes
+// it on the command line.
+const redisAuthEnv = "REDISCLI_AUTH"
+
+// command returns a redis-cli command connected to the server
+func (c *RedisConfig) command(ctx context.Context, args ...string) *exec.Cmd {
+	base := []string{"-h", c.Host, "-p", strconv.Itoa(c.Port)}
+	if c.User != "" {
+		base = append(base, "--user", c.User)
+	}
+	if c.TLS {
+		base = append(base, "--tls")
+		if c.TLSCACert != "" {
+			base = append(base, "--cacert", c.TLSCACert)
+		}
+		if c.TLSCert != "" {
+			base = append(base, "--cert", c.TLSCert, "--key", c.TLSKey)
+		}
+		if c.TLSServerName != "" {
+			base = append(base, "--sni", c.TLSServerName)
+		}
+		if c.TLSInsecure {
+			base = append(base, "--insecure")
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "redis-cli", append(base, args...)...)
+	cmd.Env = os.Environ()
+	if c.Password != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", redisAuthEnv, c.Password))
+	}
+	return cmd
+}
+
+// redisErrorPattern matches error replies, which older redis-cli versions
+// print without failing.
+var redisErrorPattern = regexp.MustCompile(`^(\(error\) )?(ERR|NOAUTH|NOPERM|WRONGPASS|LOADING|MISCONF|BUSY|READONLY|MASTERDOWN)\b`)
+
+// redisQuery runs a single command with redis-cli and returns its trimmed
+// reply.
+func redisQuery(ctx context.Context, cfg *RedisConfig, args ...string) (string, error) {
+	cmd := cfg.command(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	reply := strings.TrimSpace(string(out))
+	if err != nil {
+		return "", fmt.Errorf("redis-cli %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()+" "+reply))
+	}
+	if redisErrorPattern.MatchString(reply) {
+		return "", fmt.Errorf("redis-cli %s failed: %s", args[0], reply)
+	}
+	return reply, nil
+}
+
+// redisInfo returns the fields of an INFO section
+func redisInfo(ctx context.Context, cfg *RedisConfig, section string) (map[string]string, error) {
+	out, err := redisQuery(ctx, cfg, "INFO", section)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			fields[k] = v
+		}
+	}
+	return fields, nil
+}
+
+func (db *RedisDatabase) ValidateConfig(config core.Config) error {
+	_, err := parseRedisConfig(config)
+	return err
+}
+
+func (db *RedisDatabase) DumpExt(config core.Config) string {
+	return "rdb"
+}
+
+func (db *RedisDatabase) Backup(ctx context.Context, config core.Config, outputPath string) (string, error) {
+	return backupToFile(ctx, db, config, outputPath)
+}
+
+func (db *RedisDatabase) BackupTo(ctx context.Context, config core.Config, w io.Writer) (core.BackupInfo, error) {
+	// bgsave: BGSAVE; wait for LASTSAVE to change; copy [data_directory]/[rdb_filename] to w
+	// rdb:    redis-cli --rdb - > [w]
+
+	var info core.BackupInfo
+
+	cfg, err := parseRedisConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	// Versions are best-effort and only recorded in the manifest
+	info.DumpToolVersion = commandVersion(ctx, "redis-cli")
+	if server, err := redisInfo(ctx, cfg, "server"); err == nil {
+		info.ServerVersion = server["redis_version"]
+	}
+
+	head := &headWriter{limit: redisRDBHeaderLen}
+	out := io.MultiWriter(w, head)
+
+	if cfg.Method == RedisMethodRDB {
+		cmd := cfg.command(ctx, "--rdb", "-")
+		cmd.Stdout = out
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return info, fmt.Errorf("redis-cli --rdb failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		if err := redisBGSave(ctx, cfg); err != nil {
+			return info, err
+		}
+		// Redis renames finished snapshots into place, so the file is
+		// complete even if another save starts while it is copied.
+		f, err := os.Open(filepath.Join(cfg.DataDirectory, cfg.RDBFilename))
+		if err != nil {
+			return info, fmt.Errorf("failed to open snapshot: %v", err)
+		}
+		defer f.Close()
+		if _, err := io.Copy(out, utils.NewContextReader(ctx, f)); err != nil {
+			return info, fmt.Errorf("failed to copy snapshot: %v", err)
+		}
+	}
+
+	version, err := redisRDBVersion(head.Bytes())
+	if err != nil {
+		return info, err
+	}
+	info.Metadata = map[string]string{"rdb_version": strconv.Itoa(version)}
+
+	return info, nil
+}
+
+// redisBGSave has the server write a new snapshot and waits until it is
+// done.
+func redisBGSave(ctx context.Context, cfg *RedisConfig) error {
+	var before string
+	for {
+		// LASTSAVE is read again before every attempt, since a save that
+		// made an attempt fail may have finished since.
+		var err error
+		if before, err = redisLastSave(ctx, cfg); err != nil {
+			return err
+		}
+
+		// SCHEDULE waits for a running AOF rewrite instead of failing.
+		_, err = redisQuery(ctx, cfg, "BGSAVE", "SCHEDULE")
+		if err == nil {
+			break
+		}
+		// A save that was already running may miss the latest writes, so
+		// wait for it and start another.
+		if !strings.Contains(err.Error(), "already in progress") {
+			return err
+		}
+		if err := redisWait(ctx); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if err := redisWait(ctx); err != nil {
+			return err
+		}
+		last, err := redisQuery(ctx, cfg, "LASTSAVE")
+		if err != nil {
+			return err
+		}
+		if last != before {
+			return nil
+		}
+
+		persistence, err := redisInfo(ctx, cfg, "persistence")
+		if err != nil {
+			return err
+		}
+		if persistence["rdb_bgsave_in_progress"] == "0" && persistence["aof_rewrite_in_progress"] == "0" &&
+			persistence["rdb_last_bgsave_status"] == "err" {
+			return fmt.Errorf("BGSAVE failed, see the Redis log")
+		}
+	}
+}
+
+// redisLastSave returns the time of the last save, once the server's clock
+// has moved past it. LASTSAVE counts seconds, so a save finishing in the
+// same second as the previous one would go unnoticed.
+func redisLastSave(ctx context.Context, cfg *RedisConfig) (string, error) {
+	last, err := redisQuery(ctx, cfg, "LASTSAVE")
+	if err != nil {
+		return "", err
+	}
+	for {
+		now, err := redisQuery(ctx, cfg, "TIME")
+		if err != nil {
+			return "", err
+		}
+		if seconds, _, _ := strings.Cut(now, "\n"); strings.TrimSpace(seconds) != last {
+			return last, nil
+		}
+		if err := redisWait(ctx); err != nil {
+			return "", err
+		}
+	}
+}
+
+// redisWait pauses between polls of the server
+func redisWait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// redisRDBHeaderLen is the length of the RDB header: "REDIS" and a four
+// digit format version.
+const redisRDBHeaderLen = 9
+
+// redisRDBVersion checks that header starts an RDB file and returns its
+// format version.
+func redisRDBVersion(header []byte) (int, error) {
+	if len(header) == redisRDBHeaderLen && bytes.HasPrefix(header, []byte("REDIS")) {
+		if v, err := strconv.Atoi(string(header[5:])); err == nil {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("not an RDB file")
+}
+
+func (db *RedisDatabase) Restore(ctx context.Context, config core.Config, backupPath string, opts core.RestoreOptions) error {
+	return restoreFromFile(ctx, db, config, backupPath, opts)
+}
+
+func (db *RedisDatabase) RestoreFrom(ctx context.Context, config core.Config, r io.Reader, opts core.RestoreOptions) error {
+	// Write [data_directory]/[rdb_filename], which the server loads when it is started
+
+	cfg, err := parseRedisConfig(config)
+	if err != nil {
+		return err
+	}
+	dir := cfg.DataDirectory
+	if dir == "" {
+		return &core.FieldError{Field: "data_directory", Msg: "is required to restore"}
+	}
+
+	// A running server would overwrite the file with its own data on its
+	// next save or on shutdown.
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("redis is running at %s, stop it first", addr)
+	}
+
+	if opts.CreateDatabase {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("data directory: %v", err)
+	}
+
+	// Check the stream before anything is replaced.
+	br := bufio.NewReader(utils.NewContextReader(ctx, r))
+	header, _ := br.Peek(redisRDBHeaderLen)
+	if _, err := redisRDBVersion(header); err != nil {
+		return fmt.Errorf("backup is %v", err)
+	}
+
+	dest := filepath.Join(dir, cfg.RDBFilename)
+	// With appendonly enabled the server loads the AOF rather than the RDB.
+	aof := []string{filepath.Join(dir, "appendonlydir"), filepath.Join(dir, "appendonly.aof")}
+	for _, p := range append([]string{dest}, aof...) {
+		if _, err := os.Stat(p); err == nil && !opts.DropExisting {
+			return fmt.Errorf("%s exists, use --drop-existing to replace it", p)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+cfg.RDBFilename+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, br)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore RDB: %v", err)
+	}
+
+	for _, p := range aof {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", dest, err)
+	}
+
+	return nil
+}
+
+func (db *RedisDatabase) TestConnection(ctx context.Context, config core.Config) (core.ConnectionInfo, error) {
+	// redis-cli INFO server; ACL DRYRUN [user] [command]
+
+	var info core.ConnectionInfo
+
+	cfg, err := parseRedisConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	server, err := redisInfo(ctx, cfg, "server")
+	if err != nil {
+		return info, err
+	}
+	info.ServerVersion = server["redis_version"]
+	info.CanDump = true
+
+	needed := [][]string{{"SYNC"}}
+	if cfg.Method == RedisMethodBGSave {
+		if _, err := os.Stat(cfg.DataDirectory); err != nil {
+			info.CanDump = false
+			info.Detail = fmt.Sprintf("data directory: %v", err)
+			return info, nil
+		}
+		needed = [][]string{{"BGSAVE", "SCHEDULE"}, {"LASTSAVE"}}
+	}
+
+	user := cfg.User
+	if user == "" {
+		user = "default"
+	}
+	for _, c := range needed {
+		// ACL DRYRUN needs Redis 7 and admin rights; without them the
+		// privileges can't be checked.
+		reply, err := redisQuery(ctx, cfg, append([]string{"ACL", "DRYRUN", user}, c...)...)
+		if err != nil {
+			break
+		}
+		if reply != "OK" {
+			info.CanDump = false
+			info.Detail = reply
+			break
+		}
+	}
+
+	return info, nil
+}
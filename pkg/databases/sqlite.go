@@ -1,64 +1,259 @@
 package databases
 
 import (
+	"context"
+	"database/sql"
 	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/utils"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	// Registers the pure Go "sqlite" driver.
+	_ "modernc.org/sqlite"
 )
 
 type SQLiteDatabase struct{}
 
-func (db *SQLiteDatabase) Backup(config core.Config, outputPath string) (string, error) {
-	// SQLite backup is just copying the file
-	dbPath := config["path"].(string)
+// SQLiteConfig is the typed form of a `type: sqlite` database entry
+type SQLiteConfig struct {
+	Path string `mapstructure:"path"`
+}
+
+func parseSQLiteConfig(raw core.Config) (*SQLiteConfig, error) {
+	cfg := &SQLiteConfig{}
+	if err := decodeConfig(raw, cfg, cfg.validate); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *SQLiteConfig) validate() []error {
+	if c.Path == "" {
+		return []error{&core.FieldError{Field: "path", Msg: "is required"}}
+	}
+	return nil
+}
 
-	src, err := os.Open(dbPath)
+func (db *SQLiteDatabase) ValidateConfig(config core.Config) error {
+	_, err := parseSQLiteConfig(config)
+	return err
+}
+
+func (db *SQLiteDatabase) Backup(ctx context.Context, config core.Config, outputPath string) (string, error) {
+	return backupToFile(ctx, db, config, outputPath)
+}
+
+func (db *SQLiteDatabase) BackupTo(ctx context.Context, config core.Config, w io.Writer) (core.BackupInfo, error) {
+	// VACUUM INTO [temp file]; PRAGMA integrity_check; then copy the file to w
+	var info core.BackupInfo
+
+	cfg, err := parseSQLiteConfig(config)
 	if err != nil {
-		return "", fmt.Errorf("failed to open sqlite db: %v", err)
+		return info, err
 	}
-	defer src.Close()
 
-	dst, err := os.Create(outputPath)
+	// Opening a missing file would create it.
+	if _, err := os.Stat(cfg.Path); err != nil {
+		return info, fmt.Errorf("failed to open sqlite db: %v", err)
+	}
+	info.ServerVersion, _ = sqliteFileVersion(cfg.Path)
+
+	tmp, err := os.MkdirTemp("", "sqlite-")
+	if err != nil {
+		return info, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// Copying the file while the application writes to it, or while
+	// commits are still in the -wal file, can produce a corrupt or stale
+	// copy. VACUUM INTO writes a consistent snapshot through SQLite.
+	snapshot := filepath.Join(tmp, "snapshot.db")
+	if err := sqliteVacuumInto(ctx, cfg.Path, snapshot); err != nil {
+		return info, err
+	}
+
+	stats, err := sqliteCheck(ctx, snapshot)
+	if err != nil {
+		return info, err
+	}
+	info.Metadata = stats
+
+	src, err := os.Open(snapshot)
 	if err != nil {
-		return "", fmt.Errorf("failed to create backup file: %v", err)
+		return info, err
 	}
-	defer dst.Close()
+	defer src.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
-		return "", fmt.Errorf("failed to copy sqlite db: %v", err)
+	if _, err := io.Copy(w, utils.NewContextReader(ctx, src)); err != nil {
+		return info, fmt.Errorf("failed to copy sqlite db: %v", err)
 	}
 
-	return outputPath, nil
+	return info, nil
 }
 
-func (db *SQLiteDatabase) Restore(config core.Config, backupPath string) error {
-	// Restore is just copying back
-	dbPath := config["path"].(string)
+func (db *SQLiteDatabase) Restore(ctx context.Context, config core.Config, backupPath string, opts core.RestoreOptions) error {
+	return restoreFromFile(ctx, db, config, backupPath, opts)
+}
 
-	src, err := os.Open(backupPath)
+func (db *SQLiteDatabase) RestoreFrom(ctx context.Context, config core.Config, r io.Reader, opts core.RestoreOptions) error {
+	// Write the backup next to the db file, check it, then rename it into place
+	cfg, err := parseSQLiteConfig(config)
 	if err != nil {
-		return fmt.Errorf("failed to open backup file: %v", err)
+		return err
 	}
-	defer src.Close()
 
-	dst, err := os.Create(dbPath)
+	if _, err := os.Stat(cfg.Path); err == nil && !opts.DropExisting {
+		return fmt.Errorf("%s exists, use --drop-existing to replace it", cfg.Path)
+	}
+	if opts.CreateDatabase {
+		if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %v", cfg.Path, err)
+		}
+	}
+
+	// The rename only replaces the file atomically within a directory.
+	dst, err := os.CreateTemp(filepath.Dir(cfg.Path), "."+filepath.Base(cfg.Path)+".restore-*")
 	if err != nil {
 		return fmt.Errorf("failed to open destination db: %v", err)
 	}
-	defer dst.Close()
+	defer os.Remove(dst.Name())
 
-	if _, err := io.Copy(dst, src); err != nil {
+	_, err = io.Copy(dst, utils.NewContextReader(ctx, r))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
 		return fmt.Errorf("failed to restore sqlite db: %v", err)
 	}
 
+	if _, err := sqliteCheck(ctx, dst.Name()); err != nil {
+		return fmt.Errorf("restored sqlite db is unusable: %v", err)
+	}
+
+	// A -wal or -journal file left by the old database would be applied
+	// to the restored one when it is next opened, and corrupt it.
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(cfg.Path + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale %s file: %v", suffix, err)
+		}
+	}
+	if err := os.Rename(dst.Name(), cfg.Path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", cfg.Path, err)
+	}
+
 	return nil
 }
 
-func (db *SQLiteDatabase) TestConnection(config core.Config) error {
-	dbPath := config["path"].(string)
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		return fmt.Errorf("sqlite database file does not exist: %s", dbPath)
+// sqliteOpen opens the database at path with the pure Go driver, waiting
+// for locks held by other connections rather than failing right away.
+func sqliteOpen(path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(30000)")
+	if err != nil {
+		return nil, err
+	}
+	// PRAGMAs and VACUUM INTO must run on the same connection.
+	conn.SetMaxOpenConns(1)
+	return conn, nil
+}
+
+// sqliteVacuumInto writes a consistent, compacted copy of the database at
+// src to the new file dst.
+func sqliteVacuumInto(ctx context.Context, src, dst string) error {
+	conn, err := sqliteOpen(src)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "VACUUM INTO ?", dst); err != nil {
+		return fmt.Errorf("VACUUM INTO failed: %v", err)
 	}
 	return nil
 }
+
+// sqliteCheck runs PRAGMA integrity_check on the database at path and
+// returns its page count, page size and schema version for the manifest.
+func sqliteCheck(ctx context.Context, path string) (map[string]string, error) {
+	conn, err := sqliteOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return nil, fmt.Errorf("integrity check failed: %v", err)
+	}
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		problems = append(problems, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("integrity check failed: %v", err)
+	}
+	if len(problems) != 1 || problems[0] != "ok" {
+		return nil, fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	stats := map[string]string{}
+	for _, pragma := range []string{"page_count", "page_size", "schema_version"} {
+		var n int64
+		if err := conn.QueryRowContext(ctx, "PRAGMA "+pragma).Scan(&n); err != nil {
+			return nil, fmt.Errorf("PRAGMA %s failed: %v", pragma, err)
+		}
+		stats[pragma] = strconv.FormatInt(n, 10)
+	}
+	return stats, nil
+}
+
+func (db *SQLiteDatabase) TestConnection(ctx context.Context, config core.Config) (core.ConnectionInfo, error) {
+	var info core.ConnectionInfo
+
+	cfg, err := parseSQLiteConfig(config)
+	if err != nil {
+		return info, err
+	}
+
+	if _, err := os.Stat(cfg.Path); os.IsNotExist(err) {
+		return info, fmt.Errorf("sqlite database file does not exist: %s", cfg.Path)
+	}
+
+	version, err := sqliteFileVersion(cfg.Path)
+	if err != nil {
+		return info, err
+	}
+
+	info.ServerVersion = version
+	info.CanDump = true
+	return info, nil
+}
+
+// sqliteFileVersion reads the 100-byte database header, which starts with a
+// magic string and holds at offset 96 the version of the SQLite library that
+// last wrote the file.
+func sqliteFileVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read database file: %v", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:16]) != "SQLite format 3\x00" {
+		return "", fmt.Errorf("not a sqlite database: %s", path)
+	}
+
+	v := binary.BigEndian.Uint32(header[96:100])
+	return fmt.Sprintf("%d.%d.%d", v/1000000, v/1000%1000, v%1000), nil
+}
@@ -0,0 +1,41 @@
+package databases
+
+import (
+	"context"
+	"db-backup-tool/pkg/core"
+	"fmt"
+	"os"
+)
+
+// backupToFile runs a streaming backup into outputPath. The partial file is
+// removed if the dump fails or is cancelled.
+func backupToFile(ctx context.Context, db core.StreamingDatabase, config core.Config, outputPath string) (string, error) {
+	outfile, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %v", err)
+	}
+
+	if _, err := db.BackupTo(ctx, config, outfile); err != nil {
+		outfile.Close()
+		os.Remove(outputPath)
+		return "", err
+	}
+
+	if err := outfile.Close(); err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("failed to write backup file: %v", err)
+	}
+
+	return outputPath, nil
+}
+
+// restoreFromFile feeds backupPath to a streaming restore.
+func restoreFromFile(ctx context.Context, db core.StreamingDatabase, config core.Config, backupPath string, opts core.RestoreOptions) error {
+	infile, err := os.Open(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %v", err)
+	}
+	defer infile.Close()
+
+	return db.RestoreFrom(ctx, config, infile, opts)
+}
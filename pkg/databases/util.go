@@ -0,0 +1,83 @@
+package databases
+
+import (
+	"bytes"
+	"context"
+	"db-backup-tool/pkg/core"
+	"os"
+	"os/exec"
+)
+
+// commandVersion returns the first line printed by `name --version`, or ""
+// if the tool can't be run.
+func commandVersion(ctx context.Context, name string) string {
+	out, err := exec.CommandContext(ctx, name, "--version").Output()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	return string(bytes.TrimSpace(line))
+}
+
+// withDatabase returns a copy of config that connects to database instead
+func withDatabase(config core.Config, database string) core.Config {
+	c := make(core.Config, len(config)+1)
+	for k, v := range config {
+		c[k] = v
+	}
+	c["database"] = database
+	return c
+}
+
+// headWriter keeps the first limit bytes written to it and discards the rest
+type headWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := h.limit - h.buf.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		h.buf.Write(p[:room])
+	}
+	return len(p), nil
+}
+
+// Bytes returns the data kept so far
+func (h *headWriter) Bytes() []byte {
+	return h.buf.Bytes()
+}
+
+// secretFile writes content to a new temporary file that only the current
+// user can read, so that credentials don't have to be passed on the command
+// line. The returned cleanup overwrites and removes the file; call it once
+// the command using the file has exited, whether or not it failed.
+func secretFile(pattern string, content []byte) (string, func(), error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		if f, err := os.OpenFile(f.Name(), os.O_WRONLY, 0); err == nil {
+			f.Write(make([]byte, len(content)))
+			f.Close()
+		}
+		os.Remove(f.Name())
+	}
+
+	// CreateTemp uses 0600 already, but be explicit about it.
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
@@ -0,0 +1,347 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// MethodAESGCM is chunked AES-256-GCM with a symmetric key or passphrase.
+//
+// The stream starts with a fixed-size header:
+//
+//	magic[8] version[1] kdf[1] scryptLogN[1] scryptR[1] scryptP[1] salt[16] noncePrefix[7]
+//
+// followed by frames of up to aesChunkSize plaintext bytes, each sealed
+// separately with the header as additional data. The 12-byte nonce of a
+// frame is noncePrefix || counter (big endian uint32) || final flag, so
+// frames can't be reordered, and truncating the stream at a frame boundary
+// is detected because the last frame read isn't marked final. Every frame
+// but the final one is full size; the final frame may be empty.
+const MethodAESGCM = "aes-256-gcm"
+
+const (
+	aesMagic      = "DBBKAES\x00"
+	aesVersion    = 1
+	aesHeaderSize = 8 + 1 + 1 + 3 + 16 + 7
+	aesChunkSize  = 64 * 1024
+	aesKeySize    = 32
+
+	kdfNone   = 0
+	kdfScrypt = 1
+
+	// scrypt parameters for new backups: N=2^15, r=8, p=1
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	// Limits on the parameters read from a header, which is untrusted.
+	// scrypt needs 128*N*r bytes of memory and time proportional to N*r*p;
+	// the limits allow 1 GiB and 64 times the work of the defaults.
+	scryptMaxLogN = 20
+	scryptMaxR    = 32
+	scryptMaxP    = 16
+	scryptMaxNR   = 1 << 23
+	scryptMaxNRP  = 1 << 24
+)
+
+// Key is an AES-256 key, given either directly or as a passphrase that is
+// stretched with scrypt.
+type Key struct {
+	raw        []byte
+	passphrase []byte
+}
+
+// NewKey returns a key for 32 raw bytes
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != aesKeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", aesKeySize, len(raw))
+	}
+	return &Key{raw: raw}, nil
+}
+
+// NewPassphraseKey returns a key derived from passphrase with scrypt. A new
+// random salt is used for every backup.
+func NewPassphraseKey(passphrase string) (*Key, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	return &Key{passphrase: []byte(passphrase)}, nil
+}
+
+// ID identifies a raw key without revealing it: the first 8 bytes of its
+// SHA-256 hash. Passphrase keys have no ID since the derived key differs
+// for every backup.
+func (k *Key) ID() string {
+	if k.raw == nil {
+		return ""
+	}
+	sum := sha256.Sum256(k.raw)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *Key) Method() string {
+	return MethodAESGCM
+}
+
+func (k *Key) Ext() string {
+	return ".enc"
+}
+
+// Params describes how backups are encrypted with k, for the manifest
+func (k *Key) Params() map[string]string {
+	params := map[string]string{"chunk_size": strconv.Itoa(aesChunkSize)}
+	if k.raw != nil {
+		params["kdf"] = "none"
+		params["key_id"] = k.ID()
+	} else {
+		params["kdf"] = "scrypt"
+		params["scrypt_n"] = strconv.Itoa(1 << scryptLogN)
+		params["scrypt_r"] = strconv.Itoa(scryptR)
+		params["scrypt_p"] = strconv.Itoa(scryptP)
+	}
+	return params
+}
+
+// NewWriter encrypts everything written to it into w. Close writes the final
+// frame but doesn't close w.
+func (k *Key) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, aesHeaderSize)
+	copy(header, aesMagic)
+	header[8] = aesVersion
+	if _, err := rand.Read(header[13:]); err != nil {
+		return nil, err
+	}
+
+	key := k.raw
+	if key == nil {
+		header[9] = kdfScrypt
+		header[10], header[11], header[12] = scryptLogN, scryptR, scryptP
+		var err error
+		if key, err = k.derive(header); err != nil {
+			return nil, err
+		}
+	} else {
+		header[9] = kdfNone
+		// The salt is unused without a KDF.
+		clear(header[13:29])
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, aesChunkSize),
+	}, nil
+}
+
+// derive runs the KDF described in header on the passphrase
+func (k *Key) derive(header []byte) ([]byte, error) {
+	if header[10] > scryptMaxLogN {
+		return nil, fmt.Errorf("scrypt cost 2^%d is too high", header[10])
+	}
+	n, r, p := 1<<header[10], int(header[11]), int(header[12])
+	if r < 1 || r > scryptMaxR || p < 1 || p > scryptMaxP || n*r > scryptMaxNR || n*r*p > scryptMaxNRP {
+		return nil, fmt.Errorf("scrypt parameters N=%d r=%d p=%d are out of range", n, r, p)
+	}
+	key, err := scrypt.Key(k.passphrase, header[13:29], n, r, p, aesKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("scrypt: %v", err)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// frameNonce builds the nonce of frame number counter
+func frameNonce(header []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[29:36])
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type aesWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+func (e *aesWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encryption stream")
+	}
+	n := 0
+	for len(p) > 0 {
+		m := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+m]
+		p = p[m:]
+		n += m
+
+		if len(e.buf) == cap(e.buf) {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *aesWriter) flush(final bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("encryption stream too long")
+	}
+	sealed := e.aead.Seal(nil, frameNonce(e.header, e.counter, final), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *aesWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+// newAESReader decrypts a stream whose header has already been read, using
+// the first of keys that can open the first frame.
+func newAESReader(header []byte, r io.Reader, keys []*Key) (io.Reader, error) {
+	if header[8] != aesVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", header[8])
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKey
+	}
+
+	d := &aesReader{
+		r:      r,
+		header: header,
+		frame:  make([]byte, aesChunkSize+16),
+		buf:    make([]byte, 0, aesChunkSize),
+	}
+	sealed, final, err := d.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		var key []byte
+		switch header[9] {
+		case kdfNone:
+			key = k.raw
+		case kdfScrypt:
+			if k.passphrase != nil {
+				if key, err = k.derive(header); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unsupported key derivation %d", header[9])
+		}
+		if key == nil {
+			continue
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := aead.Open(d.buf, frameNonce(header, 0, final), sealed, header)
+		if err != nil {
+			continue
+		}
+		d.aead = aead
+		d.plain = plain
+		d.counter = 1
+		d.done = final
+		return d, nil
+	}
+	return nil, ErrWrongKey
+}
+
+type aesReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	frame   []byte
+	buf     []byte
+	plain   []byte
+	counter uint32
+	done    bool
+}
+
+// readFrame reads the next sealed frame. A short frame is the final one.
+func (d *aesReader) readFrame() ([]byte, bool, error) {
+	n, err := io.ReadFull(d.r, d.frame)
+	switch {
+	case err == nil:
+		return d.frame, false, nil
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		if n < 16 {
+			return nil, false, errors.New("encrypted stream is truncated")
+		}
+		return d.frame[:n], true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+func (d *aesReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		sealed, final, err := d.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		d.plain, err = d.aead.Open(d.buf, frameNonce(d.header, d.counter, final), sealed, d.header)
+		if err != nil {
+			return 0, fmt.Errorf("encrypted stream is corrupt or truncated: frame %d: %v", d.counter, err)
+		}
+		d.counter++
+		d.done = final
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// isAESHeader reports whether prefix starts an AES-GCM stream
+func isAESHeader(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(aesMagic))
+}
@@ -0,0 +1,232 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+const aesFrameSize = aesChunkSize + 16
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	raw := make([]byte, aesKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func testData(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// encrypt encrypts data with k, writing it in odd-sized pieces so that
+// chunking doesn't depend on the caller's writes
+func encrypt(t *testing.T, k *Key, data []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := k.NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := data; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decrypt(stream []byte, keys ...*Key) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(stream), &Keyring{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestAESRoundTrip(t *testing.T) {
+	k := testKey(t)
+	for _, n := range []int{0, 1, aesChunkSize - 1, aesChunkSize, aesChunkSize + 1, 2 * aesChunkSize, 3*aesChunkSize + 17} {
+		data := testData(t, n)
+		stream := encrypt(t, k, data)
+
+		// Every frame but the final one is full size; the final one
+		// may be empty.
+		if want := aesHeaderSize + (n/aesChunkSize)*aesFrameSize + n%aesChunkSize + 16; len(stream) != want {
+			t.Errorf("%d bytes: stream is %d bytes, want %d", n, len(stream), want)
+		}
+
+		got, err := decrypt(stream, k)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted data differs", n)
+		}
+	}
+}
+
+func TestAESPassphraseRoundTrip(t *testing.T) {
+	k, err := NewPassphraseKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testData(t, aesChunkSize+1)
+	stream := encrypt(t, k, data)
+
+	// A new salt is used for every stream.
+	if other := encrypt(t, k, data); bytes.Equal(stream[:aesHeaderSize], other[:aesHeaderSize]) {
+		t.Error("two streams share a header")
+	}
+
+	again, _ := NewPassphraseKey("correct horse")
+	got, err := decrypt(stream, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("decrypted data differs")
+	}
+}
+
+func TestAESKeyring(t *testing.T) {
+	k := testKey(t)
+	passphrase, _ := NewPassphraseKey("correct horse")
+	data := testData(t, 100)
+
+	tests := []struct {
+		name    string
+		key     *Key
+		keys    []*Key
+		wantErr error
+	}{
+		{"no keys", k, nil, ErrNoKey},
+		{"wrong key", k, []*Key{testKey(t)}, ErrWrongKey},
+		{"right key after wrong ones", k, []*Key{testKey(t), passphrase, k}, nil},
+		{"passphrase key for raw stream", k, []*Key{passphrase}, ErrWrongKey},
+		{"raw key for passphrase stream", passphrase, []*Key{k}, ErrWrongKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(encrypt(t, tt.key, data), tt.keys...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				t.Error("decrypted data differs")
+			}
+		})
+	}
+}
+
+func TestAESWrongPassphrase(t *testing.T) {
+	k, _ := NewPassphraseKey("correct horse")
+	wrong, _ := NewPassphraseKey("battery staple")
+	_, err := decrypt(encrypt(t, k, testData(t, 100)), wrong)
+	if !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("got error %v, want %v", err, ErrWrongKey)
+	}
+}
+
+// TestAESTampering checks that streams that were cut short, rearranged or
+// modified are rejected rather than decrypted to something else.
+func TestAESTampering(t *testing.T) {
+	k := testKey(t)
+	data := testData(t, 3*aesChunkSize+17)
+	stream := encrypt(t, k, data)
+	frame := func(i int) []byte {
+		start := aesHeaderSize + i*aesFrameSize
+		return stream[start:min(start+aesFrameSize, len(stream))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := stream[:aesHeaderSize]
+
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"header only", header},
+		{"truncated header", stream[:aesHeaderSize-1]},
+		{"final frame dropped", join(header, frame(0), frame(1), frame(2))},
+		{"cut inside a frame", stream[:aesHeaderSize+aesFrameSize+100]},
+		{"cut inside the final frame", stream[:len(stream)-1]},
+		{"frames swapped", join(header, frame(1), frame(0), frame(2), frame(3))},
+		{"frame duplicated", join(header, frame(0), frame(1), frame(1), frame(2), frame(3))},
+		{"frame dropped", join(header, frame(0), frame(2), frame(3))},
+		{"ciphertext modified", flipBit(stream, aesHeaderSize+aesFrameSize+5)},
+		{"tag modified", flipBit(stream, len(stream)-1)},
+		{"salt modified", flipBit(stream, 13)},
+		{"nonce prefix modified", flipBit(stream, aesHeaderSize-1)},
+		{"kdf modified", setByte(stream, 9, kdfScrypt)},
+		{"version modified", setByte(stream, 8, aesVersion+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(tt.stream, k)
+			if err == nil {
+				t.Fatalf("decrypted %d bytes without an error", len(got))
+			}
+		})
+	}
+}
+
+// TestAESScryptLimits checks that a header can't make the reader run scrypt
+// with parameters that need excessive memory or time.
+func TestAESScryptLimits(t *testing.T) {
+	k, _ := NewPassphraseKey("correct horse")
+	stream := encrypt(t, k, testData(t, 100))
+
+	tests := []struct {
+		name       string
+		logN, r, p byte
+	}{
+		{"N too high", scryptMaxLogN + 1, scryptR, scryptP},
+		{"r too high", scryptLogN, 255, scryptP},
+		{"p too high", scryptLogN, scryptR, 255},
+		{"r zero", scryptLogN, 0, scryptP},
+		{"p zero", scryptLogN, scryptR, 0},
+		{"N*r too high", scryptMaxLogN, scryptMaxR, 1},
+		{"N*r*p too high", scryptMaxLogN, 8, scryptMaxP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := setByte(setByte(setByte(stream, 10, tt.logN), 11, tt.r), 12, tt.p)
+			_, err := decrypt(tampered, k)
+			if err == nil || errors.Is(err, ErrWrongKey) {
+				t.Fatalf("got error %v, want the parameters to be rejected", err)
+			}
+		})
+	}
+}
+
+func flipBit(b []byte, i int) []byte {
+	c := bytes.Clone(b)
+	c[i] ^= 1
+	return c
+}
+
+func setByte(b []byte, i int, v byte) []byte {
+	c := bytes.Clone(b)
+	c[i] = v
+	return c
+}
@@ -0,0 +1,95 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// MethodAge encrypts backups to age X25519 recipients. The backup host only
+// needs the public recipients; the identities are only needed to restore.
+const MethodAge = "age"
+
+const ageMagic = "age-encryption.org/"
+
+type ageEncrypter struct {
+	recipients []age.Recipient
+	names      []string
+}
+
+// NewAgeEncrypter parses age recipients ("age1...") given inline or in
+// recipients files with one recipient per line.
+func NewAgeEncrypter(recipients, files []string) (Encrypter, error) {
+	e := &ageEncrypter{}
+	for _, s := range recipients {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, err
+		}
+		e.recipients = append(e.recipients, r)
+		e.names = append(e.names, s)
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recipients file: %v", err)
+		}
+		rs, err := age.ParseRecipients(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("recipients file %s: %v", path, err)
+		}
+		e.recipients = append(e.recipients, rs...)
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				e.names = append(e.names, line)
+			}
+		}
+	}
+	if len(e.recipients) == 0 {
+		return nil, errors.New("no age recipients configured")
+	}
+	return e, nil
+}
+
+func (e *ageEncrypter) Method() string {
+	return MethodAge
+}
+
+func (e *ageEncrypter) Ext() string {
+	return ".age"
+}
+
+func (e *ageEncrypter) Params() map[string]string {
+	return map[string]string{"recipients": strings.Join(e.names, ",")}
+}
+
+func (e *ageEncrypter) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, e.recipients...)
+}
+
+// parseAgeIdentities reads an age identity file ("AGE-SECRET-KEY-1...")
+func parseAgeIdentities(data []byte) ([]age.Identity, error) {
+	return age.ParseIdentities(bytes.NewReader(data))
+}
+
+func newAgeReader(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, ErrNoKey
+	}
+	dr, err := age.Decrypt(r, identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, ErrWrongKey
+	}
+	return dr, err
+}
+
+// isAgeHeader reports whether prefix starts an age file
+func isAgeHeader(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(ageMagic))
+}
@@ -0,0 +1,290 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"db-backup-tool/pkg/core"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// ErrNoKey is returned when an encrypted backup is read without any keys
+var ErrNoKey = errors.New("backup is encrypted but no decryption key is configured")
+
+// ErrWrongKey is returned when none of the keys can decrypt a backup
+var ErrWrongKey = errors.New("none of the configured keys can decrypt this backup")
+
+// Encrypter is a pipeline stage that encrypts backups
+type Encrypter interface {
+	// Method is recorded in the manifest, e.g. "aes-256-gcm"
+	Method() string
+	// Ext is appended to the artifact name, e.g. ".enc"
+	Ext() string
+	// Params are recorded in the manifest so that the right key can be
+	// found again after a key rotation.
+	Params() map[string]string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// Keyring holds the keys that may be needed to decrypt a backup: the
+// current symmetric key and any previous ones, plus the age and OpenPGP
+// private keys given at restore time.
+type Keyring struct {
+	Keys []*Key
+
+	ageIdentities []age.Identity
+	pgpKeys       openpgp.EntityList
+}
+
+// AddIdentityFile adds the private keys in an age identity file or an
+// OpenPGP secret key file. passphrase unlocks protected OpenPGP keys.
+func (kr *Keyring) AddIdentityFile(path string, passphrase []byte) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read identity file: %v", err)
+	}
+
+	if bytes.Contains(data, []byte("AGE-SECRET-KEY-")) {
+		ids, err := parseAgeIdentities(data)
+		if err != nil {
+			return fmt.Errorf("identity file %s: %v", path, err)
+		}
+		kr.ageIdentities = append(kr.ageIdentities, ids...)
+		return nil
+	}
+
+	keys, err := parsePGPIdentities(data, passphrase)
+	if err != nil {
+		return fmt.Errorf("identity file %s: %v", path, err)
+	}
+	kr.pgpKeys = append(kr.pgpKeys, keys...)
+	return nil
+}
+
+// CanDecrypt reports whether kr holds any keys for method. It doesn't check
+// that they are the right ones.
+func (kr *Keyring) CanDecrypt(method string) bool {
+	switch method {
+	case "":
+		return true
+	case MethodAESGCM:
+		return len(kr.Keys) > 0
+	case MethodAge:
+		return len(kr.ageIdentities) > 0
+	case MethodPGP:
+		return len(kr.pgpKeys) > 0
+	default:
+		return false
+	}
+}
+
+// NewReader returns a reader that decrypts r if it is encrypted, and passes
+// it through unchanged otherwise. The format is recognised by its header.
+func NewReader(r io.Reader, kr *Keyring) (io.Reader, error) {
+	if kr == nil {
+		kr = &Keyring{}
+	}
+
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(aesHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case isAESHeader(prefix):
+		if len(prefix) < aesHeaderSize {
+			return nil, errors.New("encrypted stream is truncated")
+		}
+		header := make([]byte, aesHeaderSize)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, err
+		}
+		return newAESReader(header, br, kr.Keys)
+	case isAgeHeader(prefix):
+		return newAgeReader(br, kr.ageIdentities)
+	case isPGPHeader(prefix):
+		return newPGPReader(br, kr.pgpKeys)
+	default:
+		return br, nil
+	}
+}
+
+// Exts are the extensions added by the Encrypters
+var Exts = []string{".enc", ".age", ".gpg"}
+
+// TrimExt removes the extension added by an Encrypter from name
+func TrimExt(name string) string {
+	for _, ext := range Exts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// KeySource says where a key comes from. Exactly one field must be set.
+type KeySource struct {
+	// KeyFile holds 32 bytes, raw or hex/base64 encoded
+	KeyFile string `mapstructure:"key_file"`
+	// KeyEnv names an environment variable holding a hex/base64 key
+	KeyEnv        string `mapstructure:"key_env"`
+	Passphrase    string `mapstructure:"passphrase"`
+	PassphraseEnv string `mapstructure:"passphrase_env"`
+}
+
+// Config is the typed form of the encryption section of the config file
+type Config struct {
+	// Method is empty (no encryption), "aes-256-gcm", "age" or "pgp"
+	Method    string `mapstructure:"method"`
+	KeySource `mapstructure:",squash"`
+	// Recipients are age public keys ("age1...")
+	Recipients []string `mapstructure:"recipients"`
+	// RecipientFiles are age recipients files or OpenPGP public keys
+	RecipientFiles []string `mapstructure:"recipient_files"`
+	// PreviousKeys are only used to decrypt backups taken before a key
+	// rotation.
+	PreviousKeys []KeySource `mapstructure:"previous_keys"`
+}
+
+// ParseConfig decodes and checks an encryption section
+func ParseConfig(raw core.Config) (*Config, error) {
+	cfg := &Config{}
+	if err := core.DecodeConfig(raw, cfg); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	switch cfg.Method {
+	case "":
+	case MethodAESGCM:
+		if err := cfg.KeySource.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	case MethodAge:
+		if len(cfg.Recipients) == 0 && len(cfg.RecipientFiles) == 0 {
+			errs = append(errs, &core.FieldError{Field: "recipients", Msg: "at least one recipient or recipient file is required for age"})
+		}
+	case MethodPGP:
+		if len(cfg.RecipientFiles) == 0 {
+			errs = append(errs, &core.FieldError{Field: "recipient_files", Msg: "at least one public key file is required for pgp"})
+		}
+		if len(cfg.Recipients) > 0 {
+			errs = append(errs, &core.FieldError{Field: "recipients", Msg: "is only supported for age, use recipient_files"})
+		}
+	default:
+		errs = append(errs, &core.FieldError{Field: "method", Msg: fmt.Sprintf("unsupported encryption method %q", cfg.Method)})
+	}
+	for i, src := range cfg.PreviousKeys {
+		if err := src.validate(); err != nil {
+			errs = append(errs, core.PrefixFieldErrors(fmt.Sprintf("previous_keys[%d]", i), err))
+		}
+	}
+	return cfg, errors.Join(errs...)
+}
+
+func (s KeySource) validate() error {
+	set := 0
+	for _, v := range []string{s.KeyFile, s.KeyEnv, s.Passphrase, s.PassphraseEnv} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return &core.FieldError{Field: "key_file", Msg: "exactly one of key_file, key_env, passphrase or passphrase_env must be set"}
+	}
+	return nil
+}
+
+// Encrypter returns the encrypter for new backups, or nil if encryption is
+// disabled.
+func (c *Config) Encrypter() (Encrypter, error) {
+	switch c.Method {
+	case "":
+		return nil, nil
+	case MethodAge:
+		return NewAgeEncrypter(c.Recipients, c.RecipientFiles)
+	case MethodPGP:
+		return NewPGPEncrypter(c.RecipientFiles)
+	default:
+		return c.KeySource.Load()
+	}
+}
+
+// Keyring loads every configured symmetric key for decryption. Private keys
+// for age and OpenPGP are never part of the config; add them with
+// AddIdentityFile.
+func (c *Config) Keyring() (*Keyring, error) {
+	kr := &Keyring{}
+	sources := c.PreviousKeys
+	if c.Method == MethodAESGCM {
+		sources = append([]KeySource{c.KeySource}, sources...)
+	}
+	for _, src := range sources {
+		k, err := src.Load()
+		if err != nil {
+			return nil, err
+		}
+		kr.Keys = append(kr.Keys, k)
+	}
+	return kr, nil
+}
+
+// Load reads the key
+func (s KeySource) Load() (*Key, error) {
+	switch {
+	case s.KeyFile != "":
+		data, err := os.ReadFile(s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		if len(data) == aesKeySize {
+			return NewKey(data)
+		}
+		raw, err := decodeKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %v", s.KeyFile, err)
+		}
+		return NewKey(raw)
+	case s.KeyEnv != "":
+		v := os.Getenv(s.KeyEnv)
+		if v == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", s.KeyEnv)
+		}
+		raw, err := decodeKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s: %v", s.KeyEnv, err)
+		}
+		return NewKey(raw)
+	case s.Passphrase != "":
+		return NewPassphraseKey(s.Passphrase)
+	case s.PassphraseEnv != "":
+		v := os.Getenv(s.PassphraseEnv)
+		if v == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", s.PassphraseEnv)
+		}
+		return NewPassphraseKey(v)
+	default:
+		return nil, errors.New("no key configured")
+	}
+}
+
+// decodeKey accepts a 32-byte key encoded as hex or base64
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if raw, err := hex.DecodeString(s); err == nil && len(raw) == aesKeySize {
+		return raw, nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(s); err == nil && len(raw) == aesKeySize {
+		return raw, nil
+	}
+	return nil, fmt.Errorf("expected a %d-byte key encoded as hex or base64", aesKeySize)
+}
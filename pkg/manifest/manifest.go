@@ -0,0 +1,140 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/storage"
+	"db-backup-tool/pkg/utils"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffix is appended to an artifact's path to form the path of its manifest
+const Suffix = ".manifest.json"
+
+// Manifest describes a stored backup. It is written as JSON next to the
+// backup artifact and is what list, restore and retention work from.
+type Manifest struct {
+	ID           string `json:"id"`
+	Database     string `json:"database"`
+	DatabaseType string `json:"database_type"`
+	// Artifact is the storage path of the backup file
+	Artifact string `json:"artifact"`
+
+	ServerVersion   string `json:"server_version,omitempty"`
+	DumpToolVersion string `json:"dump_tool_version,omitempty"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+
+	// RawSize is the size of the dump, StoredSize that of the artifact
+	// after compression (and encryption)
+	RawSize     int64  `json:"raw_size"`
+	StoredSize  int64  `json:"stored_size"`
+	Compression string `json:"compression"`
+	Encryption  string `json:"encryption,omitempty"`
+	// EncryptionParams records the KDF and key ID used, see
+	// encryption.Encrypter
+	EncryptionParams map[string]string `json:"encryption_params,omitempty"`
+	// SHA256 is the hex checksum of the stored artifact
+	SHA256 string `json:"sha256"`
+
+	ToolVersion string `json:"tool_version"`
+	Hostname    string `json:"hostname"`
+
+	// Metadata holds engine-specific details such as binlog coordinates
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Globals is a dump of server-wide objects such as roles and
+	// tablespaces, stored next to the artifact when requested.
+	Globals *Part `json:"globals,omitempty"`
+}
+
+// Part is an additional file stored with a backup. It is compressed and
+// encrypted like the artifact.
+type Part struct {
+	Artifact   string `json:"artifact"`
+	RawSize    int64  `json:"raw_size"`
+	StoredSize int64  `json:"stored_size"`
+	SHA256     string `json:"sha256"`
+}
+
+// ForPart returns a copy of m that describes p instead of the artifact, so
+// that it can be verified and read like one.
+func (m *Manifest) ForPart(p *Part) *Manifest {
+	pm := *m
+	pm.Artifact = p.Artifact
+	pm.RawSize = p.RawSize
+	pm.StoredSize = p.StoredSize
+	pm.SHA256 = p.SHA256
+	pm.Globals = nil
+	return &pm
+}
+
+// PathFor returns the manifest path for an artifact
+func PathFor(artifact string) string {
+	return artifact + Suffix
+}
+
+// Write stores m next to its artifact
+func Write(ctx context.Context, store core.Storage, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+
+	if _, err := storage.Put(ctx, store, bytes.NewReader(data), PathFor(m.Artifact)); err != nil {
+		return fmt.Errorf("failed to upload manifest: %v", err)
+	}
+	return nil
+}
+
+// Read loads the manifest stored at path
+func Read(ctx context.Context, store core.Storage, path string) (*Manifest, error) {
+	rc, err := storage.Open(ctx, store, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// List reads every manifest under prefix, oldest first. Manifests that
+// can't be read are logged and skipped, so that one corrupt file doesn't
+// hide every other backup.
+func List(ctx context.Context, store core.Storage, prefix string) ([]*Manifest, error) {
+	files, err := store.ListFiles(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*Manifest
+	for _, f := range files {
+		if !strings.HasSuffix(f, Suffix) {
+			continue
+		}
+		m, err := Read(ctx, store, f)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			utils.LogError(fmt.Sprintf("Skipping manifest %s: %v", f, err))
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].StartTime.Before(manifests[j].StartTime)
+	})
+	return manifests, nil
+}
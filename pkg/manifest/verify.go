@@ -0,0 +1,128 @@
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/pipeline"
+	"db-backup-tool/pkg/storage"
+	"db-backup-tool/pkg/utils"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Check reads the whole artifact from r and verifies it against m: the size
+// and SHA-256 checksum must match, and the payload must decrypt and
+// decompress to the end without errors. Encrypted artifacts are only checked
+// against their checksum if kr holds no keys.
+func Check(r io.Reader, m *Manifest, kr *encryption.Keyring) error {
+	var size pipeline.Counter
+	hash := sha256.New()
+	tr := io.TeeReader(r, io.MultiWriter(hash, &size))
+
+	payloadErr := checkPayload(tr, m, kr)
+
+	// Drain anything after the payload so the checksum covers the whole
+	// object.
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return err
+	}
+
+	// A size or checksum mismatch explains a payload error, so report it
+	// first.
+	if err := m.checkDigest(size.N, hash); err != nil {
+		return err
+	}
+	return payloadErr
+}
+
+// checkPayload decrypts and decompresses r, discarding the output
+func checkPayload(r io.Reader, m *Manifest, kr *encryption.Keyring) error {
+	dr, err := encryption.NewReader(r, kr)
+	if errors.Is(err, encryption.ErrNoKey) {
+		return nil
+	}
+	if errors.Is(err, encryption.ErrWrongKey) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("corrupt: decryption: %v", err)
+	}
+
+	if m.Compression != "gzip" {
+		if _, err := io.Copy(io.Discard, dr); err != nil {
+			return fmt.Errorf("corrupt: %v", err)
+		}
+		return nil
+	}
+
+	zr, err := utils.NewDecompressReader(dr)
+	if err == nil {
+		_, err = io.Copy(io.Discard, zr)
+	}
+	if err != nil {
+		return fmt.Errorf("corrupt: gzip stream: %v", err)
+	}
+	return nil
+}
+
+// Verify downloads the artifact described by m and runs Check on it
+func Verify(ctx context.Context, store core.Storage, m *Manifest, kr *encryption.Keyring) error {
+	rc, err := storage.Open(ctx, store, m.Artifact)
+	if err != nil {
+		return fmt.Errorf("missing: %v", err)
+	}
+	defer rc.Close()
+
+	return Check(rc, m, kr)
+}
+
+type verifyingReader struct {
+	r    io.Reader
+	m    *Manifest
+	hash hash.Hash
+	n    int64
+}
+
+// NewVerifyingReader returns a reader that passes r through unchanged but,
+// instead of io.EOF, returns an error if the data read doesn't match the
+// size and checksum recorded in m. Manifests without a checksum are not
+// checked.
+func NewVerifyingReader(r io.Reader, m *Manifest) io.Reader {
+	return &verifyingReader{r: r, m: m, hash: sha256.New()}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.n += int64(n)
+
+	if err == io.EOF {
+		if verr := v.m.checkDigest(v.n, v.hash); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// checkDigest compares the size and hash of the data read with the values
+// recorded at backup time.
+func (m *Manifest) checkDigest(size int64, h hash.Hash) error {
+	if m.SHA256 == "" {
+		return nil
+	}
+	switch {
+	case size < m.StoredSize:
+		return fmt.Errorf("truncated: read %d of %d bytes", size, m.StoredSize)
+	case size > m.StoredSize:
+		return fmt.Errorf("corrupt: read %d bytes, expected %d", size, m.StoredSize)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != m.SHA256 {
+		return fmt.Errorf("corrupt: sha256 %s, expected %s", sum, m.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package manifest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"db-backup-tool/pkg/encryption"
+	"db-backup-tool/pkg/storage"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// manifestFor returns a manifest recording the size and checksum of artifact
+func manifestFor(artifact []byte) *Manifest {
+	sum := sha256.Sum256(artifact)
+	return &Manifest{
+		StoredSize:  int64(len(artifact)),
+		Compression: "gzip",
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+}
+
+func TestCheck(t *testing.T) {
+	artifact := gzipped(t, bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 1000))
+	m := manifestFor(artifact)
+
+	modified := bytes.Clone(artifact)
+	modified[len(modified)/2] ^= 1
+
+	noChecksum := *m
+	noChecksum.SHA256 = ""
+
+	tests := []struct {
+		name     string
+		artifact []byte
+		m        *Manifest
+		wantErr  string
+	}{
+		{"match", artifact, m, ""},
+		{"truncated", artifact[:len(artifact)-10], m, "truncated: read"},
+		{"trailing data", append(bytes.Clone(artifact), 0), m, "corrupt: read"},
+		{"checksum mismatch", modified, m, "corrupt: sha256"},
+		{"no checksum recorded", artifact, &noChecksum, ""},
+		{"no checksum recorded, corrupt gzip", artifact[:len(artifact)-10], &noChecksum, "corrupt: gzip stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(bytes.NewReader(tt.artifact), tt.m, nil)
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheckEncrypted(t *testing.T) {
+	newKey := func() *encryption.Key {
+		raw := make([]byte, 32)
+		rand.Read(raw)
+		k, err := encryption.NewKey(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	key, otherKey := newKey(), newKey()
+
+	var buf bytes.Buffer
+	w, err := key.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(gzipped(t, []byte("dump")))
+	w.Close()
+	artifact := buf.Bytes()
+	m := manifestFor(artifact)
+
+	tests := []struct {
+		name    string
+		kr      *encryption.Keyring
+		wantErr error
+	}{
+		// Without keys only the checksum can be checked.
+		{"no keys", nil, nil},
+		{"right key", &encryption.Keyring{Keys: []*encryption.Key{key}}, nil},
+		{"wrong key", &encryption.Keyring{Keys: []*encryption.Key{otherKey}}, encryption.ErrWrongKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Check(bytes.NewReader(artifact), m, tt.kr); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	artifact := gzipped(t, []byte("dump"))
+	path := filepath.Join(dir, "db-1.sql.gz")
+	if err := os.WriteFile(path, artifact, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := manifestFor(artifact)
+	m.Artifact = path
+	wrongSize := *m
+	wrongSize.StoredSize++
+	wrongSum := *m
+	wrongSum.SHA256 = strings.Repeat("0", 64)
+	missing := *m
+	missing.Artifact = filepath.Join(dir, "db-2.sql.gz")
+
+	tests := []struct {
+		name    string
+		m       *Manifest
+		wantErr string
+	}{
+		{"match", m, ""},
+		{"size mismatch", &wrongSize, "truncated: read"},
+		{"checksum mismatch", &wrongSum, "corrupt: sha256"},
+		{"missing artifact", &missing, "missing:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(context.Background(), &storage.LocalStorage{}, tt.m, nil)
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	artifact := gzipped(t, []byte("dump"))
+	m := manifestFor(artifact)
+	modified := bytes.Clone(artifact)
+	modified[len(modified)-1] ^= 1
+
+	tests := []struct {
+		name     string
+		artifact []byte
+		wantErr  string
+	}{
+		{"match", artifact, ""},
+		{"truncated", artifact[:len(artifact)-1], "truncated: read"},
+		{"checksum mismatch", modified, "corrupt: sha256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(NewVerifyingReader(bytes.NewReader(tt.artifact), m))
+			checkErr(t, err, tt.wantErr)
+			// The data is passed through unchanged either way.
+			if !bytes.Equal(got, tt.artifact) {
+				t.Error("data differs")
+			}
+		})
+	}
+}
+
+// checkErr checks that err is nil if wantErr is empty, and otherwise
+// contains wantErr
+func checkErr(t *testing.T, err error, wantErr string) {
+	t.Helper()
+	switch {
+	case wantErr == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)):
+		t.Fatalf("got error %v, want one containing %q", err, wantErr)
+	}
+}
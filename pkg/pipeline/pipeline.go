@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Stage wraps a writer with a transformation such as compression or
+// encryption. Data written to the returned writer is transformed and passed
+// on to w; Close flushes the stage but must not close w.
+type Stage func(w io.Writer) (io.WriteCloser, error)
+
+// Producer writes the raw backup (e.g. a database dump) to w.
+type Producer func(ctx context.Context, w io.Writer) error
+
+// Consumer reads the transformed backup from r (e.g. a storage upload).
+type Consumer func(ctx context.Context, r io.Reader) error
+
+// Run connects producer -> stages... -> consumer with an io.Pipe so that
+// nothing is buffered on local disk. If any side fails, the other side is
+// unblocked with the same error and ctx is cancelled, which stops a running
+// dump process or aborts an in-flight upload. A panic on either side is
+// returned as an error like any other failure.
+func Run(ctx context.Context, produce Producer, stages []Stage, consume Consumer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Only the first failure is reported; the error seen by the other side
+	// ("closed pipe", "context canceled") is just a consequence of it.
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	pr, pw := io.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := recovered(func() error { return runProducer(ctx, produce, stages, pw) })
+		if err != nil {
+			fail(err)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	if err := recovered(func() error { return consume(ctx, pr) }); err != nil {
+		fail(err)
+		// Unblock the producer if the consumer stopped reading early.
+		pr.CloseWithError(err)
+	}
+	<-done
+
+	return firstErr
+}
+
+// recovered calls f and turns a panic into an error, so that a bug in one
+// database adapter fails its own backup rather than the whole process.
+func recovered(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
+
+func runProducer(ctx context.Context, produce Producer, stages []Stage, pw io.Writer) error {
+	// Build the chain back to front so that the first stage is the one the
+	// producer writes into.
+	var w io.Writer = pw
+	closers := make([]io.Closer, 0, len(stages))
+	for i := len(stages) - 1; i >= 0; i-- {
+		wc, err := stages[i](w)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, wc)
+		w = wc
+	}
+
+	if err := produce(ctx, w); err != nil {
+		return err
+	}
+
+	// Flush front to back: the first stage has to finish writing into the
+	// next one before that one is closed.
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counter is an io.Writer that counts the bytes written to it. Combine it
+// with io.MultiWriter or io.TeeReader to measure a stage's throughput.
+type Counter struct {
+	N int64
+}
+
+func (c *Counter) Write(p []byte) (int, error) {
+	c.N += int64(len(p))
+	return len(p), nil
+}
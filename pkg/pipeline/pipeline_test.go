@@ -0,0 +1,194 @@
+package pipeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// produceBytes writes n bytes in small pieces
+func produceBytes(n int) Producer {
+	return func(ctx context.Context, w io.Writer) error {
+		_, err := io.CopyBuffer(w, io.LimitReader(zeros{}, int64(n)), make([]byte, 512))
+		return err
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func consumeAll(ctx context.Context, r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// runWithTimeout fails the test if Run doesn't return, e.g. because one
+// side is left blocked on the pipe.
+func runWithTimeout(t *testing.T, produce Producer, stages []Stage, consume Consumer) error {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- Run(context.Background(), produce, stages, consume) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run deadlocked")
+		return nil
+	}
+}
+
+func TestRunPanics(t *testing.T) {
+	tests := []struct {
+		name    string
+		produce Producer
+		consume Consumer
+	}{
+		{
+			name: "producer",
+			produce: func(ctx context.Context, w io.Writer) error {
+				w.Write([]byte("partial"))
+				panic("adapter bug")
+			},
+			consume: consumeAll,
+		},
+		{
+			name:    "consumer",
+			produce: produceBytes(1 << 20),
+			consume: func(ctx context.Context, r io.Reader) error {
+				r.Read(make([]byte, 10))
+				panic("adapter bug")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runWithTimeout(t, tt.produce, nil, tt.consume)
+			if err == nil || !strings.Contains(err.Error(), "panic: adapter bug") {
+				t.Fatalf("got error %v, want the panic", err)
+			}
+		})
+	}
+}
+
+var (
+	errProduce = errors.New("dump failed")
+	errStage   = errors.New("stage failed")
+	errConsume = errors.New("upload failed")
+)
+
+// failingWriter fails once more than limit bytes have been written to it
+type failingWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.limit -= len(p); f.limit < 0 {
+		return 0, errStage
+	}
+	return f.w.Write(p)
+}
+
+func (f *failingWriter) Close() error { return nil }
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		produce Producer
+		stages  []Stage
+		consume Consumer
+		wantErr error
+	}{
+		{
+			name: "producer fails",
+			produce: func(ctx context.Context, w io.Writer) error {
+				w.Write([]byte("partial dump"))
+				return errProduce
+			},
+			consume: consumeAll,
+			wantErr: errProduce,
+		},
+		{
+			name:    "stage can't be created",
+			produce: produceBytes(1 << 20),
+			stages: []Stage{func(w io.Writer) (io.WriteCloser, error) {
+				return nil, errStage
+			}},
+			consume: consumeAll,
+			wantErr: errStage,
+		},
+		{
+			name:    "stage fails while writing",
+			produce: produceBytes(1 << 20),
+			stages: []Stage{func(w io.Writer) (io.WriteCloser, error) {
+				return &failingWriter{w: w, limit: 4096}, nil
+			}},
+			consume: consumeAll,
+			wantErr: errStage,
+		},
+		{
+			name:    "consumer stops reading early",
+			produce: produceBytes(1 << 20),
+			consume: func(ctx context.Context, r io.Reader) error {
+				r.Read(make([]byte, 10))
+				return errConsume
+			},
+			wantErr: errConsume,
+		},
+		{
+			name: "consumer failure cancels the producer",
+			produce: func(ctx context.Context, w io.Writer) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			consume: func(ctx context.Context, r io.Reader) error {
+				return errConsume
+			},
+			wantErr: errConsume,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runWithTimeout(t, tt.produce, tt.stages, tt.consume)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunStages(t *testing.T) {
+	want := bytes.Repeat([]byte("row\n"), 100000)
+	produce := func(ctx context.Context, w io.Writer) error {
+		_, err := w.Write(want)
+		return err
+	}
+	gzipStage := func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	}
+
+	var got []byte
+	consume := func(ctx context.Context, r io.Reader) error {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		got, err = io.ReadAll(zr)
+		return err
+	}
+	if err := runWithTimeout(t, produce, []Stage{gzipStage}, consume); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("consumer read %d bytes, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,151 @@
+package retention
+
+import (
+	"db-backup-tool/pkg/core"
+	"db-backup-tool/pkg/manifest"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Policy decides which backups of a database are kept. The keep rules work
+// like grandfather-father-son rotation: KeepDaily 7 keeps the newest backup
+// of each of the last 7 days that have a backup, and so on. A backup is kept
+// if any rule selects it, unless it is older than MaxAge.
+type Policy struct {
+	KeepLast    int           `mapstructure:"keep_last"`
+	KeepHourly  int           `mapstructure:"keep_hourly"`
+	KeepDaily   int           `mapstructure:"keep_daily"`
+	KeepWeekly  int           `mapstructure:"keep_weekly"`
+	KeepMonthly int           `mapstructure:"keep_monthly"`
+	MaxAge      time.Duration `mapstructure:"max_age"`
+
+	// AutoPrune applies the policy after every successful backup
+	AutoPrune bool `mapstructure:"auto_prune"`
+}
+
+// ParsePolicy decodes a retention section of the config file
+func ParsePolicy(raw core.Config) (Policy, error) {
+	var p Policy
+	if err := core.DecodeConfig(raw, &p); err != nil {
+		return p, err
+	}
+
+	var errs []error
+	for field, n := range map[string]int{
+		"keep_last":    p.KeepLast,
+		"keep_hourly":  p.KeepHourly,
+		"keep_daily":   p.KeepDaily,
+		"keep_weekly":  p.KeepWeekly,
+		"keep_monthly": p.KeepMonthly,
+	} {
+		if n < 0 {
+			errs = append(errs, &core.FieldError{Field: field, Msg: "must not be negative"})
+		}
+	}
+	if p.MaxAge < 0 {
+		errs = append(errs, &core.FieldError{Field: "max_age", Msg: "must not be negative"})
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return p, errors.Join(errs...)
+}
+
+// IsZero reports whether p has no rules, in which case nothing is pruned
+func (p Policy) IsZero() bool {
+	return p.KeepLast == 0 && p.KeepHourly == 0 && p.KeepDaily == 0 &&
+		p.KeepWeekly == 0 && p.KeepMonthly == 0 && p.MaxAge == 0
+}
+
+func (p Policy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepHourly > 0 || p.KeepDaily > 0 ||
+		p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+// Decision is the outcome of a policy for one backup
+type Decision struct {
+	Manifest *manifest.Manifest
+	Keep     bool
+	// Reasons lists the rules that kept or removed the backup
+	Reasons []string
+}
+
+// Apply evaluates p against the backups of a single database and returns one
+// decision per backup, newest first. The newest backup is always kept so
+// that a stalled schedule can't age out the last good copy.
+func Apply(backups []*manifest.Manifest, p Policy, now time.Time) []Decision {
+	sorted := make([]*manifest.Manifest, len(backups))
+	copy(sorted, backups)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].StartTime.After(sorted[j].StartTime)
+	})
+
+	decisions := make([]Decision, len(sorted))
+	for i, m := range sorted {
+		decisions[i].Manifest = m
+	}
+	if p.IsZero() {
+		for i := range decisions {
+			decisions[i].Keep = true
+		}
+		return decisions
+	}
+
+	keep := func(i int, reason string) {
+		decisions[i].Keep = true
+		decisions[i].Reasons = append(decisions[i].Reasons, reason)
+	}
+
+	for i := 0; i < p.KeepLast && i < len(decisions); i++ {
+		keep(i, "last")
+	}
+
+	buckets := []struct {
+		name  string
+		count int
+		key   func(t time.Time) string
+	}{
+		{"hourly", p.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		seen := make(map[string]bool)
+		for i, d := range decisions {
+			if len(seen) >= b.count {
+				break
+			}
+			k := b.key(d.Manifest.StartTime.Local())
+			if !seen[k] {
+				seen[k] = true
+				keep(i, b.name)
+			}
+		}
+	}
+
+	// With only max_age set, everything younger than it is kept.
+	if !p.hasKeepRules() {
+		for i := range decisions {
+			decisions[i].Keep = true
+		}
+	}
+
+	if p.MaxAge > 0 {
+		for i, d := range decisions {
+			if now.Sub(d.Manifest.StartTime) > p.MaxAge {
+				decisions[i].Keep = false
+				decisions[i].Reasons = []string{"older than max_age"}
+			}
+		}
+	}
+
+	if len(decisions) > 0 && !decisions[0].Keep {
+		decisions[0].Keep = true
+		decisions[0].Reasons = []string{"newest"}
+	}
+	return decisions
+}
@@ -0,0 +1,282 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"db-backup-tool/pkg/manifest"
+)
+
+// backupsAt returns a manifest per time, in RFC 3339, with the time as ID
+func backupsAt(t *testing.T, times ...string) []*manifest.Manifest {
+	t.Helper()
+	var backups []*manifest.Manifest
+	for _, s := range times {
+		start, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, &manifest.Manifest{ID: s, StartTime: start})
+	}
+	return backups
+}
+
+// kept returns the IDs of the kept backups, newest first
+func kept(decisions []Decision) []string {
+	var ids []string
+	for _, d := range decisions {
+		if d.Keep {
+			ids = append(ids, d.Manifest.ID)
+		}
+	}
+	return ids
+}
+
+func TestApply(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		backups []string
+		want    []string
+	}{
+		{
+			name:    "no rules keeps everything",
+			policy:  Policy{},
+			backups: []string{"2026-10-01T00:00:00Z", "2020-01-01T00:00:00Z"},
+			want:    []string{"2026-10-01T00:00:00Z", "2020-01-01T00:00:00Z"},
+		},
+		{
+			name:   "keep_last",
+			policy: Policy{KeepLast: 2},
+			backups: []string{
+				"2026-10-18T09:00:00Z", "2026-10-18T10:00:00Z", "2026-10-18T11:00:00Z",
+			},
+			want: []string{"2026-10-18T11:00:00Z", "2026-10-18T10:00:00Z"},
+		},
+		{
+			name:   "keep_last larger than the number of backups",
+			policy: Policy{KeepLast: 10},
+			backups: []string{
+				"2026-10-18T09:00:00Z", "2026-10-18T10:00:00Z",
+			},
+			want: []string{"2026-10-18T10:00:00Z", "2026-10-18T09:00:00Z"},
+		},
+		{
+			name:   "hourly keeps the newest backup of each hour",
+			policy: Policy{KeepHourly: 2},
+			backups: []string{
+				"2026-10-18T09:50:00Z",
+				"2026-10-18T10:05:00Z", "2026-10-18T10:40:00Z",
+				"2026-10-18T11:10:00Z", "2026-10-18T11:50:00Z",
+			},
+			want: []string{"2026-10-18T11:50:00Z", "2026-10-18T10:40:00Z"},
+		},
+		{
+			name:   "daily counts days that have a backup",
+			policy: Policy{KeepDaily: 3},
+			backups: []string{
+				"2026-10-01T02:00:00Z",
+				"2026-10-05T02:00:00Z",
+				"2026-10-10T02:00:00Z", "2026-10-10T14:00:00Z",
+				"2026-10-17T02:00:00Z",
+			},
+			want: []string{"2026-10-17T02:00:00Z", "2026-10-10T14:00:00Z", "2026-10-05T02:00:00Z"},
+		},
+		{
+			name:   "weekly uses ISO weeks, which start on Monday",
+			policy: Policy{KeepWeekly: 3},
+			backups: []string{
+				"2026-10-03T02:00:00Z", // Saturday, week 40
+				"2026-10-04T23:00:00Z", // Sunday, week 40
+				"2026-10-05T01:00:00Z", // Monday, week 41
+				"2026-10-11T02:00:00Z", // Sunday, week 41
+				"2026-10-12T02:00:00Z", // Monday, week 42
+			},
+			want: []string{"2026-10-12T02:00:00Z", "2026-10-11T02:00:00Z", "2026-10-04T23:00:00Z"},
+		},
+		{
+			name:   "weekly across the new year",
+			policy: Policy{KeepWeekly: 2},
+			backups: []string{
+				"2026-12-27T02:00:00Z", // Sunday, 2026-W52
+				"2026-12-28T02:00:00Z", // Monday, 2026-W53
+				"2027-01-01T02:00:00Z", // Friday, still 2026-W53
+				"2027-01-03T02:00:00Z", // Sunday, still 2026-W53
+			},
+			want: []string{"2027-01-03T02:00:00Z", "2026-12-27T02:00:00Z"},
+		},
+		{
+			name:   "monthly",
+			policy: Policy{KeepMonthly: 2},
+			backups: []string{
+				"2026-08-31T23:00:00Z",
+				"2026-09-01T01:00:00Z", "2026-09-30T23:00:00Z",
+				"2026-10-01T01:00:00Z",
+			},
+			want: []string{"2026-10-01T01:00:00Z", "2026-09-30T23:00:00Z"},
+		},
+		{
+			name:   "rules overlap",
+			policy: Policy{KeepLast: 2, KeepDaily: 2, KeepMonthly: 2},
+			backups: []string{
+				"2026-09-15T02:00:00Z",
+				"2026-10-16T02:00:00Z",
+				"2026-10-17T02:00:00Z", "2026-10-17T14:00:00Z",
+				"2026-10-18T02:00:00Z", "2026-10-18T10:00:00Z",
+			},
+			want: []string{
+				"2026-10-18T10:00:00Z", // last, daily, monthly
+				"2026-10-18T02:00:00Z", // last
+				"2026-10-17T14:00:00Z", // daily
+				"2026-09-15T02:00:00Z", // monthly
+			},
+		},
+		{
+			name:   "max_age alone keeps everything younger",
+			policy: Policy{MaxAge: 48 * time.Hour},
+			backups: []string{
+				"2026-10-15T12:00:00Z", "2026-10-17T12:00:00Z", "2026-10-18T11:00:00Z",
+			},
+			want: []string{"2026-10-18T11:00:00Z", "2026-10-17T12:00:00Z"},
+		},
+		{
+			name:   "max_age overrides the keep rules",
+			policy: Policy{KeepMonthly: 12, MaxAge: 60 * 24 * time.Hour},
+			backups: []string{
+				"2026-06-15T02:00:00Z", "2026-07-15T02:00:00Z", "2026-08-15T02:00:00Z",
+				"2026-09-15T02:00:00Z", "2026-10-15T02:00:00Z",
+			},
+			want: []string{"2026-10-15T02:00:00Z", "2026-09-15T02:00:00Z"},
+		},
+		{
+			name:   "the newest backup is kept even if older than max_age",
+			policy: Policy{MaxAge: time.Hour},
+			backups: []string{
+				"2026-10-01T02:00:00Z", "2026-10-02T02:00:00Z",
+			},
+			want: []string{"2026-10-02T02:00:00Z"},
+		},
+		{
+			name:   "the newest backup is kept by a rule that selects none",
+			policy: Policy{KeepHourly: 1, MaxAge: time.Hour},
+			backups: []string{
+				"2026-10-01T02:00:00Z",
+			},
+			want: []string{"2026-10-01T02:00:00Z"},
+		},
+	}
+
+	old := time.Local
+	t.Cleanup(func() { time.Local = old })
+	time.Local = time.UTC
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backups := backupsAt(t, tt.backups...)
+			// The input order doesn't matter.
+			slices.Reverse(backups)
+			got := kept(Apply(backups, tt.policy, now))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestApplyTimezone checks that hours, days, weeks and months are those of
+// the local time zone rather than of UTC.
+func TestApplyTimezone(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	// Around midnight UTC at the end of September, and at the end of the
+	// Sunday of ISO week 40
+	monthEnd := []string{"2026-09-30T22:00:00Z", "2026-09-30T23:30:00Z", "2026-10-01T00:30:00Z"}
+	weekEnd := []string{"2026-10-04T22:00:00Z", "2026-10-04T23:30:00Z", "2026-10-05T00:30:00Z"}
+
+	tests := []struct {
+		name    string
+		offset  int
+		policy  Policy
+		backups []string
+		want    []string
+	}{
+		{
+			name:    "daily in UTC",
+			policy:  Policy{KeepDaily: 2},
+			backups: monthEnd,
+			want:    []string{"2026-10-01T00:30:00Z", "2026-09-30T23:30:00Z"},
+		},
+		{
+			name:    "daily four hours behind UTC, all on September 30",
+			offset:  -4,
+			policy:  Policy{KeepDaily: 2},
+			backups: monthEnd,
+			want:    []string{"2026-10-01T00:30:00Z"},
+		},
+		{
+			name:    "daily nine hours ahead of UTC, all on October 1",
+			offset:  9,
+			policy:  Policy{KeepDaily: 2},
+			backups: monthEnd,
+			want:    []string{"2026-10-01T00:30:00Z"},
+		},
+		{
+			name:    "weekly in UTC",
+			policy:  Policy{KeepWeekly: 2},
+			backups: weekEnd,
+			want:    []string{"2026-10-05T00:30:00Z", "2026-10-04T23:30:00Z"},
+		},
+		{
+			name:    "weekly four hours behind UTC, all on Sunday",
+			offset:  -4,
+			policy:  Policy{KeepWeekly: 2},
+			backups: weekEnd,
+			want:    []string{"2026-10-05T00:30:00Z"},
+		},
+		{
+			name:    "monthly in UTC",
+			policy:  Policy{KeepMonthly: 2},
+			backups: monthEnd,
+			want:    []string{"2026-10-01T00:30:00Z", "2026-09-30T23:30:00Z"},
+		},
+		{
+			name:    "monthly four hours behind UTC",
+			offset:  -4,
+			policy:  Policy{KeepMonthly: 2},
+			backups: monthEnd,
+			want:    []string{"2026-10-01T00:30:00Z"},
+		},
+	}
+
+	old := time.Local
+	t.Cleanup(func() { time.Local = old })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			time.Local = time.FixedZone("test", tt.offset*3600)
+			got := kept(Apply(backupsAt(t, tt.backups...), tt.policy, now))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyReasons(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	backups := backupsAt(t, "2026-10-18T10:00:00Z", "2026-10-18T11:00:00Z", "2020-01-01T00:00:00Z")
+	decisions := Apply(backups, Policy{KeepLast: 1, KeepDaily: 1, MaxAge: 365 * 24 * time.Hour}, now)
+
+	want := map[string][]string{
+		"2026-10-18T11:00:00Z": {"last", "daily"},
+		"2026-10-18T10:00:00Z": nil,
+		"2020-01-01T00:00:00Z": {"older than max_age"},
+	}
+	for _, d := range decisions {
+		if !slices.Equal(d.Reasons, want[d.Manifest.ID]) {
+			t.Errorf("%s: reasons %v, want %v", d.Manifest.ID, d.Reasons, want[d.Manifest.ID])
+		}
+	}
+}
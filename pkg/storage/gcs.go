@@ -2,11 +2,15 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 type GCSStorage struct {
@@ -14,9 +18,20 @@ type GCSStorage struct {
 	bucket string
 }
 
-func NewGCSStorage(bucket string) (*GCSStorage, error) {
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+// NewGCSStorage creates a GCS storage adapter. If endpoint is set, the client
+// talks to that URL without credentials, which allows testing against a local
+// fake-gcs-server (e.g. http://localhost:4443/storage/v1/).
+func NewGCSStorage(ctx context.Context, bucket, endpoint string) (*GCSStorage, error) {
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts,
+			option.WithEndpoint(endpoint),
+			option.WithoutAuthentication(),
+			storage.WithJSONReads(),
+		)
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCS client: %v", err)
 	}
@@ -24,8 +39,7 @@ func NewGCSStorage(bucket string) (*GCSStorage, error) {
 	return &GCSStorage{client: client, bucket: bucket}, nil
 }
 
-func (s *GCSStorage) Upload(localPath, remotePath string) (string, error) {
-	ctx := context.Background()
+func (s *GCSStorage) Upload(ctx context.Context, localPath, remotePath string) (string, error) {
 	file, err := os.Open(localPath)
 	if err != nil {
 		return "", fmt.Errorf("unable to open file %v", err)
@@ -43,10 +57,102 @@ func (s *GCSStorage) Upload(localPath, remotePath string) (string, error) {
 	return fmt.Sprintf("gs://%s/%s", s.bucket, remotePath), nil
 }
 
-func (s *GCSStorage) Download(remotePath, localPath string) (string, error) {
-	return "", fmt.Errorf("download not implemented yet")
+func (s *GCSStorage) Download(ctx context.Context, remotePath, localPath string) (string, error) {
+	obj := s.client.Bucket(s.bucket).Object(remotePath)
+
+	// Pin the read to the generation that exists right now so that an
+	// overwrite during a long download can't mix two versions of the object.
+	attrs, err := obj.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return "", notFound(remotePath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Object.Attrs: %v", err)
+	}
+
+	rc, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Object.NewReader: %v", err)
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return "", err
+	}
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to create file %v", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, rc); err != nil {
+		file.Close()
+		os.Remove(localPath)
+		return "", fmt.Errorf("io.Copy: %v", err)
+	}
+
+	return localPath, nil
+}
+
+func (s *GCSStorage) ListFiles(ctx context.Context, prefix string) ([]string, error) {
+	var files []string
+
+	it := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bucket.Objects: %v", err)
+		}
+		files = append(files, attrs.Name)
+	}
+	return files, nil
+}
+
+func (s *GCSStorage) Delete(ctx context.Context, path string) error {
+	err := s.client.Bucket(s.bucket).Object(path).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("Object.Delete: %v", err)
+	}
+	return nil
+}
+
+func (s *GCSStorage) UploadStream(ctx context.Context, r io.Reader, remotePath string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wc := s.client.Bucket(s.bucket).Object(remotePath).NewWriter(ctx)
+	if _, err := io.Copy(wc, r); err != nil {
+		// Cancelling before Close aborts the upload instead of committing
+		// a truncated object.
+		cancel()
+		wc.Close()
+		return "", fmt.Errorf("io.Copy: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		return "", fmt.Errorf("Writer.Close: %v", err)
+	}
+
+	return fmt.Sprintf("gs://%s/%s", s.bucket, remotePath), nil
 }
 
-func (s *GCSStorage) ListFiles(prefix string) ([]string, error) {
-	return nil, fmt.Errorf("list files not implemented yet")
+func (s *GCSStorage) DownloadStream(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	obj := s.client.Bucket(s.bucket).Object(remotePath)
+
+	attrs, err := obj.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, notFound(remotePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Object.Attrs: %v", err)
+	}
+
+	rc, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Object.NewReader: %v", err)
+	}
+	return rc, nil
 }
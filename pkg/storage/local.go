@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"db-backup-tool/pkg/utils"
 	"io"
 	"os"
 	"path/filepath"
@@ -8,7 +10,7 @@ import (
 
 type LocalStorage struct{}
 
-func (s *LocalStorage) Upload(localPath, remotePath string) (string, error) {
+func (s *LocalStorage) Upload(ctx context.Context, localPath, remotePath string) (string, error) {
 	// For local storage, "upload" is just copying to the destination directory
 	// remotePath here is treated as the destination directory or full path
 
@@ -30,16 +32,20 @@ func (s *LocalStorage) Upload(localPath, remotePath string) (string, error) {
 	}
 	defer dst.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
+	if _, err := io.Copy(dst, utils.NewContextReader(ctx, src)); err != nil {
+		os.Remove(destPath)
 		return "", err
 	}
 
 	return destPath, nil
 }
 
-func (s *LocalStorage) Download(remotePath, localPath string) (string, error) {
+func (s *LocalStorage) Download(ctx context.Context, remotePath, localPath string) (string, error) {
 	// For local storage, "download" is copying from the source
 	src, err := os.Open(remotePath)
+	if os.IsNotExist(err) {
+		return "", notFound(remotePath)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -51,19 +57,28 @@ func (s *LocalStorage) Download(remotePath, localPath string) (string, error) {
 	}
 	defer dst.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
+	if _, err := io.Copy(dst, utils.NewContextReader(ctx, src)); err != nil {
+		os.Remove(localPath)
 		return "", err
 	}
 
 	return localPath, nil
 }
 
-func (s *LocalStorage) ListFiles(prefix string) ([]string, error) {
+func (s *LocalStorage) ListFiles(ctx context.Context, prefix string) ([]string, error) {
+	// Like an object store, a prefix with nothing under it is just empty.
+	if _, err := os.Stat(prefix); os.IsNotExist(err) {
+		return nil, nil
+	}
+
 	var files []string
 	err := filepath.Walk(prefix, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !info.IsDir() {
 			files = append(files, path)
 		}
@@ -71,3 +86,40 @@ func (s *LocalStorage) ListFiles(prefix string) ([]string, error) {
 	})
 	return files, err
 }
+
+func (s *LocalStorage) Delete(ctx context.Context, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) UploadStream(ctx context.Context, r io.Reader, remotePath string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(remotePath), 0755); err != nil {
+		return "", err
+	}
+
+	dst, err := os.Create(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, utils.NewContextReader(ctx, r)); err != nil {
+		os.Remove(remotePath)
+		return "", err
+	}
+
+	return remotePath, nil
+}
+
+func (s *LocalStorage) DownloadStream(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	f, err := os.Open(remotePath)
+	if os.IsNotExist(err) {
+		return nil, notFound(remotePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -2,12 +2,19 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Storage struct {
@@ -15,24 +22,32 @@ type S3Storage struct {
 	bucket string
 }
 
-func NewS3Storage(bucket string, region string) (*S3Storage, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+// NewS3Storage creates an S3 storage adapter. If endpoint is set, requests are
+// sent there instead of AWS, which allows using S3-compatible servers such as
+// MinIO for testing. usePathStyle addresses buckets as http://host/bucket.
+func NewS3Storage(ctx context.Context, bucket, region, endpoint string, usePathStyle bool) (*S3Storage, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
 		return nil, fmt.Errorf("unable to load SDK config, %v", err)
 	}
 
-	client := s3.NewFromConfig(cfg)
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = usePathStyle
+	})
 	return &S3Storage{client: client, bucket: bucket}, nil
 }
 
-func (s *S3Storage) Upload(localPath, remotePath string) (string, error) {
+func (s *S3Storage) Upload(ctx context.Context, localPath, remotePath string) (string, error) {
 	file, err := os.Open(localPath)
 	if err != nil {
 		return "", fmt.Errorf("unable to open file %v", err)
 	}
 	defer file.Close()
 
-	_, err = s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(remotePath),
 		Body:   file,
@@ -44,12 +59,101 @@ func (s *S3Storage) Upload(localPath, remotePath string) (string, error) {
 	return fmt.Sprintf("s3://%s/%s", s.bucket, remotePath), nil
 }
 
-func (s *S3Storage) Download(remotePath, localPath string) (string, error) {
-	// Basic download implementation
-	// In a real scenario, we'd use a downloader manager for large files
-	return "", fmt.Errorf("download not implemented yet")
+func (s *S3Storage) Download(ctx context.Context, remotePath, localPath string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return "", err
+	}
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to create file %v", err)
+	}
+	defer file.Close()
+
+	// The download manager fetches large objects in parallel ranged parts
+	// and writes them at their offsets, so the file is streamed to disk
+	// without being buffered in memory.
+	downloader := manager.NewDownloader(s.client)
+	_, err = downloader.Download(ctx, file, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(remotePath),
+	})
+	if err != nil {
+		file.Close()
+		os.Remove(localPath)
+		if isS3NotFound(err) {
+			return "", notFound(remotePath)
+		}
+		return "", fmt.Errorf("unable to download file, %v", err)
+	}
+
+	return localPath, nil
+}
+
+func (s *S3Storage) ListFiles(ctx context.Context, prefix string) ([]string, error) {
+	var files []string
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list objects, %v", err)
+		}
+		for _, obj := range page.Contents {
+			files = append(files, aws.ToString(obj.Key))
+		}
+	}
+	return files, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, path string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete object, %v", err)
+	}
+	return nil
+}
+
+func (s *S3Storage) UploadStream(ctx context.Context, r io.Reader, remotePath string) (string, error) {
+	// The upload manager splits the stream into multipart chunks, so the
+	// total size doesn't need to be known up front.
+	uploader := manager.NewUploader(s.client)
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(remotePath),
+		Body:   r,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to upload stream, %v", err)
+	}
+
+	return fmt.Sprintf("s3://%s/%s", s.bucket, remotePath), nil
+}
+
+func (s *S3Storage) DownloadStream(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(remotePath),
+	})
+	if isS3NotFound(err) {
+		return nil, notFound(remotePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to download file, %v", err)
+	}
+	return out.Body, nil
 }
 
-func (s *S3Storage) ListFiles(prefix string) ([]string, error) {
-	return nil, fmt.Errorf("list files not implemented yet")
+// isS3NotFound reports whether err says the object doesn't exist. Some
+// S3-compatible servers answer 404 without the NoSuchKey code.
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &noSuchKey) ||
+		errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
 }
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"db-backup-tool/pkg/core"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrNotFound is wrapped by the errors of reads of objects that don't exist,
+// as opposed to reads that failed.
+var ErrNotFound = errors.New("object not found")
+
+func notFound(remotePath string) error {
+	return fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+}
+
+// Open returns a reader for remotePath. Backends that support streaming are
+// read directly; otherwise the object is downloaded to a temporary file
+// which is removed on Close.
+func Open(ctx context.Context, store core.Storage, remotePath string) (io.ReadCloser, error) {
+	if s, ok := store.(core.StreamingStorage); ok {
+		return s.DownloadStream(ctx, remotePath)
+	}
+
+	tmp, err := os.CreateTemp("", "backup-tool-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+
+	if _, err := store.Download(ctx, remotePath, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &tempFile{File: f}, nil
+}
+
+// Put uploads the contents of r to remotePath, staging it in a temporary
+// file if the backend can't upload streams.
+func Put(ctx context.Context, store core.Storage, r io.Reader, remotePath string) (string, error) {
+	if s, ok := store.(core.StreamingStorage); ok {
+		return s.UploadStream(ctx, r, remotePath)
+	}
+
+	tmp, err := os.CreateTemp("", "backup-tool-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return store.Upload(ctx, tmp.Name(), remotePath)
+}
+
+// tempFile deletes itself when closed
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -63,3 +63,18 @@ func DecompressFile(sourcePath string) (string, error) {
 
 	return destPath, nil
 }
+
+// NewCompressWriter returns a writer that gzip-compresses everything written
+// to it into w. Close must be called to flush the gzip footer.
+func NewCompressWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// NewDecompressReader returns a reader that decompresses the gzip stream r.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	return zr, nil
+}